@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Metric 是Collector向外暴露的数据项类型，与发送给Zabbix的ZabbixData是同一种结构，
+// 复用它可以让所有Collector实现直接把采集结果喂给ZabbixSender，无需额外转换
+type Metric = ZabbixData
+
+// Collector 是一种可插拔的数据源：daemon模式下Scheduler按Interval()返回的周期
+// 反复调用Collect，并把结果通过共享的ZabbixSender推送出去。新增数据源（攻击日志、
+// 证书到期、集群健康等）只需实现这个接口，不需要改动run()或main()
+type Collector interface {
+	// Name 返回用于日志和错误上报的标识，建议包含数据源类型和区分信息
+	Name() string
+	// Collect 采集一次数据；daemon模式下ctx由Scheduler在进程收到退出信号时取消
+	Collect(ctx context.Context) ([]Metric, error)
+	// Interval 返回该Collector的采集周期
+	Interval() time.Duration
+}
+
+// Name 实现Collector接口
+func (w *WAFCollector) Name() string {
+	return fmt.Sprintf("waf[%s/%s]", w.zabbixHost, w.dataType)
+}
+
+// Interval 实现Collector接口。配置文件中可以按目标覆盖采集周期
+// （DeviceConfig.Interval），没有覆盖时按数据粒度类型返回默认周期
+func (w *WAFCollector) Interval() time.Duration {
+	if w.interval > 0 {
+		return w.interval
+	}
+	switch w.dataType {
+	case "mins":
+		return time.Minute
+	case "hours":
+		return time.Hour
+	case "days":
+		return 24 * time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// Collect 实现Collector接口，采集一次数据但不负责发送，发送由Scheduler统一处理
+func (w *WAFCollector) Collect(ctx context.Context) ([]Metric, error) {
+	return w.collectAllData(ctx)
+}
+
+// Scheduler 在daemon模式下为每个Collector维护一个独立的ticker，并把采集结果
+// 通过共享的ZabbixSender推送，避免像cron那样每个数据粒度各自起一个进程、
+// 每次调用都要重新登录WAF
+type Scheduler struct {
+	collectors []Collector
+	sender     *ZabbixSender
+}
+
+// NewScheduler 创建调度器
+func NewScheduler(sender *ZabbixSender, collectors ...Collector) *Scheduler {
+	return &Scheduler{collectors: collectors, sender: sender}
+}
+
+// Run 启动所有Collector各自的采集循环，阻塞直到ctx被取消
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range s.collectors {
+		wg.Add(1)
+		go func(c Collector) {
+			defer wg.Done()
+			s.runCollector(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// runCollector 立即执行一次采集，然后按Interval()周期性重复，直到ctx被取消
+func (s *Scheduler) runCollector(ctx context.Context, c Collector) {
+	s.tick(ctx, c)
+
+	ticker := time.NewTicker(c.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.tick(ctx, c)
+		case <-ctx.Done():
+			logger.Info("collector已停止", "collector", c.Name())
+			return
+		}
+	}
+}
+
+// tick 执行一次采集并通过共享sender推送结果。每次tick生成一个trace_id绑定到
+// ctx上，使这次采集和推送产生的所有日志可以关联起来
+func (s *Scheduler) tick(ctx context.Context, c Collector) {
+	ctx = withTraceID(ctx, newTraceID())
+	log := loggerFrom(ctx)
+
+	metrics, err := c.Collect(ctx)
+	if err != nil {
+		log.Error("collector采集失败", "collector", c.Name(), "error", err)
+		return
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	result, err := s.sender.Send(ctx, metrics)
+	if err != nil {
+		log.Error("collector发送数据失败", "collector", c.Name(), "error", err)
+		return
+	}
+	selfStats.recordZabbixSend(result.Processed, result.Failed)
+
+	log.Info("collector采集完成", "collector", c.Name(), "count", len(metrics),
+		"processed", result.Processed, "failed", result.Failed)
+}
+
+// daemonOptions 创建daemon模式所需的一组WAFCollector所需的共享参数
+type daemonOptions struct {
+	WAFHost        string
+	Token          string
+	ZabbixServer   string
+	ZabbixHost     string
+	ZabbixTLS      *ZabbixTLSConfig
+	ChunkSize      int
+	Concurrency    int
+	RateLimit      int
+	GeoIPDBPath    string
+	GeoIPASNDBPath string
+	State          *StateStore
+}
+
+// runDaemon 以daemon模式长驻运行：为mins/hours/days三种数据粒度各创建一个
+// WAFCollector，分别注册为Collector由Scheduler按各自的周期调度，统一通过
+// 一个共享的ZabbixSender推送。三个WAFCollector共享同一个wafSession，
+// 限流器和登录态只有一份，不会把-rate-limit/-concurrency对同一个WAF
+// 应用三次，也不会重复登录三次。相比cron每次都新建进程重新登录WAF，
+// daemon模式只在启动时登录一次，后续仅按需刷新设备ID/站点缓存
+func runDaemon(opts daemonOptions) {
+	sender := NewZabbixSender(opts.ZabbixServer, opts.ZabbixTLS)
+	sender.SetChunkSize(opts.ChunkSize)
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	rateLimit := opts.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = concurrency * 2
+	}
+	session := newWAFSession(rateLimit, opts.GeoIPDBPath, opts.GeoIPASNDBPath)
+
+	dataTypes := []string{"mins", "hours", "days"}
+	collectors := make([]Collector, 0, len(dataTypes))
+	for _, dataType := range dataTypes {
+		collectors = append(collectors, NewWAFCollector(WAFCollectorOptions{
+			WAFHost:      opts.WAFHost,
+			Token:        opts.Token,
+			ZabbixServer: opts.ZabbixServer,
+			ZabbixHost:   opts.ZabbixHost,
+			DataType:     dataType,
+			ZabbixTLS:    opts.ZabbixTLS,
+			ChunkSize:    opts.ChunkSize,
+			Concurrency:  opts.Concurrency,
+			State:        opts.State,
+			Session:      session,
+		}))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("以daemon模式启动", "zabbix_host", opts.ZabbixHost, "collectors", len(collectors))
+	NewScheduler(sender, collectors...).Run(ctx)
+	logger.Info("daemon已退出")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCollector是一个可配置的Collector实现，用来在不经过真实WAF API/Zabbix
+// sender的情况下测试Scheduler的调度逻辑
+type fakeCollector struct {
+	name     string
+	interval time.Duration
+
+	collectCount int32
+	metrics      []Metric
+	err          error
+}
+
+func (f *fakeCollector) Name() string            { return f.name }
+func (f *fakeCollector) Interval() time.Duration { return f.interval }
+func (f *fakeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	atomic.AddInt32(&f.collectCount, 1)
+	return f.metrics, f.err
+}
+
+func TestSchedulerTickCallsCollectAndSkipsSendWhenNoMetrics(t *testing.T) {
+	c := &fakeCollector{name: "fake", interval: time.Minute}
+	s := NewScheduler(nil, c)
+
+	s.tick(context.Background(), c)
+
+	if got := atomic.LoadInt32(&c.collectCount); got != 1 {
+		t.Fatalf("tick应该调用一次Collect: got %d", got)
+	}
+}
+
+func TestSchedulerRunCollectorStopsOnContextCancel(t *testing.T) {
+	c := &fakeCollector{name: "fake", interval: 5 * time.Millisecond}
+	s := NewScheduler(nil, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		s.runCollector(ctx, c)
+		close(done)
+	}()
+
+	// 等待runCollector至少跑过几轮ticker，确认它没有提前退出
+	time.Sleep(30 * time.Millisecond)
+	if got := atomic.LoadInt32(&c.collectCount); got < 2 {
+		t.Fatalf("取消前collector应该已经被多次调用: got %d", got)
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ctx取消后runCollector应该退出，但没有在超时内返回")
+	}
+}
+
+func TestSchedulerRunWaitsForAllCollectors(t *testing.T) {
+	a := &fakeCollector{name: "a", interval: 5 * time.Millisecond}
+	b := &fakeCollector{name: "b", interval: 5 * time.Millisecond}
+	s := NewScheduler(nil, a, b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Run(ctx)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Run应该在所有collector的runCollector退出后返回")
+	}
+
+	if atomic.LoadInt32(&a.collectCount) == 0 || atomic.LoadInt32(&b.collectCount) == 0 {
+		t.Fatalf("Run应该调度到每一个collector: a=%d b=%d", a.collectCount, b.collectCount)
+	}
+}
+
+func TestWAFCollectorIntervalFallsBackToDataTypeDefault(t *testing.T) {
+	cases := []struct {
+		dataType string
+		want     time.Duration
+	}{
+		{"mins", time.Minute},
+		{"hours", time.Hour},
+		{"days", 24 * time.Hour},
+		{"unknown", time.Minute},
+	}
+
+	for _, tc := range cases {
+		w := &WAFCollector{dataType: tc.dataType}
+		if got := w.Interval(); got != tc.want {
+			t.Fatalf("dataType=%s: Interval()=%v, want %v", tc.dataType, got, tc.want)
+		}
+	}
+}
+
+func TestWAFCollectorIntervalOverridesDataTypeDefault(t *testing.T) {
+	w := &WAFCollector{dataType: "mins", interval: 30 * time.Second}
+	if got := w.Interval(); got != 30*time.Second {
+		t.Fatalf("显式设置的interval应该覆盖dataType默认值: got %v", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 配置文件的顶层结构，支持一个共享的zabbix_server块加多个WAF设备
+type Config struct {
+	Mode         string             `yaml:"mode"`
+	GeoIPDB      string             `yaml:"geoip_db"`
+	GeoIPASNDB   string             `yaml:"geoip_asn_db"` // ASN(.mmdb)数据库路径，用于补充geoip_db的City库不含的ISP信息
+	ZabbixServer ZabbixServerConfig `yaml:"zabbix_server"`
+	Devices      []DeviceConfig     `yaml:"devices"`
+}
+
+// ZabbixServerConfig 所有设备共用的Zabbix server连接参数
+type ZabbixServerConfig struct {
+	Address   string `yaml:"address"`
+	TLSMode   string `yaml:"tls_mode"`
+	TLSCert   string `yaml:"tls_cert"`
+	TLSKey    string `yaml:"tls_key"`
+	PSKID     string `yaml:"psk_identity"`
+	PSKKey    string `yaml:"psk_key"`
+	ChunkSize int    `yaml:"chunk_size"`
+}
+
+// DeviceConfig 单个WAF设备的配置，对应一个独立的WAFCollector实例
+type DeviceConfig struct {
+	WAFHost      string        `yaml:"waf_host"`
+	Token        string        `yaml:"token"`
+	ZabbixHost   string        `yaml:"zabbix_host"`
+	DataType     string        `yaml:"data_type"`
+	Interval     time.Duration `yaml:"interval"` // 覆盖按DataType推算的默认采集周期，daemon模式下生效，0表示不覆盖
+	Concurrency  int           `yaml:"concurrency"`
+	RateLimit    int           `yaml:"rate_limit"`
+	IncludeSites []string      `yaml:"include_sites"`
+	ExcludeSites []string      `yaml:"exclude_sites"`
+}
+
+// LoadConfig 读取并解析yaml配置文件
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+
+	if cfg.ZabbixServer.Address == "" {
+		return nil, fmt.Errorf("配置文件缺少zabbix_server.address")
+	}
+	if len(cfg.Devices) == 0 {
+		return nil, fmt.Errorf("配置文件未定义任何devices")
+	}
+
+	for i, dev := range cfg.Devices {
+		if dev.WAFHost == "" || dev.Token == "" || dev.ZabbixHost == "" {
+			return nil, fmt.Errorf("devices[%d] 缺少必填字段 waf_host/token/zabbix_host", i)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// toOptions 将DeviceConfig、共享的zabbix_server配置、geoip_db/geoip_asn_db路径和
+// 共享的采集游标存储转换为NewWAFCollector所需的WAFCollectorOptions
+func (d DeviceConfig) toOptions(server ZabbixServerConfig, geoipDB, geoipASNDB string, state *StateStore) WAFCollectorOptions {
+	dataType := d.DataType
+	if dataType == "" {
+		dataType = "mins"
+	}
+
+	var tlsConfig *ZabbixTLSConfig
+	if server.TLSMode != "" && server.TLSMode != string(ZabbixTLSNone) {
+		tlsConfig = &ZabbixTLSConfig{
+			Mode:        ZabbixTLSMode(server.TLSMode),
+			CertFile:    server.TLSCert,
+			KeyFile:     server.TLSKey,
+			PSKIdentity: server.PSKID,
+			PSKKey:      server.PSKKey,
+		}
+	}
+
+	return WAFCollectorOptions{
+		WAFHost:        d.WAFHost,
+		Token:          d.Token,
+		ZabbixServer:   server.Address,
+		ZabbixHost:     d.ZabbixHost,
+		DataType:       dataType,
+		Interval:       d.Interval,
+		ZabbixTLS:      tlsConfig,
+		ChunkSize:      server.ChunkSize,
+		Concurrency:    d.Concurrency,
+		RateLimit:      d.RateLimit,
+		SiteFilter:     newSiteNameFilter(d.IncludeSites, d.ExcludeSites),
+		GeoIPDBPath:    geoipDB,
+		GeoIPASNDBPath: geoipASNDB,
+		State:          state,
+	}
+}
+
+// siteNameFilter 按站点名称的包含/排除正则列表过滤站点；包含列表为空时默认全部放行，
+// 排除列表优先于包含列表
+type siteNameFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newSiteNameFilter 编译include/exclude正则列表；无法编译的表达式会被忽略并记录警告
+func newSiteNameFilter(include, exclude []string) *siteNameFilter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+
+	f := &siteNameFilter{}
+	for _, pattern := range include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Warn("include_sites正则编译失败，已忽略", "pattern", pattern, "error", err)
+			continue
+		}
+		f.include = append(f.include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Warn("exclude_sites正则编译失败，已忽略", "pattern", pattern, "error", err)
+			continue
+		}
+		f.exclude = append(f.exclude, re)
+	}
+
+	return f
+}
+
+// allow 判断站点名称是否通过过滤条件
+func (f *siteNameFilter) allow(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
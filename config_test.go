@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zabmetrics.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("写入测试配置文件失败: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigParsesDevicesAndInterval(t *testing.T) {
+	path := writeTestConfig(t, `
+mode: daemon
+zabbix_server:
+  address: 127.0.0.1:10051
+  chunk_size: 100
+devices:
+  - waf_host: https://waf1.example.com
+    token: tok1
+    zabbix_host: waf1
+    data_type: mins
+    interval: 30s
+  - waf_host: https://waf2.example.com
+    token: tok2
+    zabbix_host: waf2
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig返回错误: %v", err)
+	}
+	if cfg.Mode != "daemon" {
+		t.Fatalf("mode解析不正确: got %q", cfg.Mode)
+	}
+	if len(cfg.Devices) != 2 {
+		t.Fatalf("devices数量不正确: got %d", len(cfg.Devices))
+	}
+	if cfg.Devices[0].Interval != 30*time.Second {
+		t.Fatalf("interval解析不正确: got %v", cfg.Devices[0].Interval)
+	}
+	if cfg.Devices[1].Interval != 0 {
+		t.Fatalf("未设置interval的设备应该为0: got %v", cfg.Devices[1].Interval)
+	}
+}
+
+func TestLoadConfigRejectsMissingZabbixServerAddress(t *testing.T) {
+	path := writeTestConfig(t, `
+devices:
+  - waf_host: https://waf1.example.com
+    token: tok1
+    zabbix_host: waf1
+`)
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("缺少zabbix_server.address时应该返回错误")
+	}
+}
+
+func TestLoadConfigRejectsDeviceMissingRequiredFields(t *testing.T) {
+	path := writeTestConfig(t, `
+zabbix_server:
+  address: 127.0.0.1:10051
+devices:
+  - waf_host: https://waf1.example.com
+    zabbix_host: waf1
+`)
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("devices缺少token时应该返回错误")
+	}
+}
+
+func TestLoadConfigRejectsEmptyDevices(t *testing.T) {
+	path := writeTestConfig(t, `
+zabbix_server:
+  address: 127.0.0.1:10051
+devices: []
+`)
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("没有devices时应该返回错误")
+	}
+}
+
+func TestSiteNameFilterAllowsEverythingWhenEmpty(t *testing.T) {
+	f := newSiteNameFilter(nil, nil)
+	if !f.allow("anything") {
+		t.Fatalf("没有include/exclude时应该放行所有站点")
+	}
+}
+
+func TestSiteNameFilterInclude(t *testing.T) {
+	f := newSiteNameFilter([]string{"^prod-"}, nil)
+	if !f.allow("prod-web") {
+		t.Fatalf("匹配include正则的站点应该被放行")
+	}
+	if f.allow("staging-web") {
+		t.Fatalf("不匹配include正则的站点应该被过滤")
+	}
+}
+
+func TestSiteNameFilterExcludeTakesPriorityOverInclude(t *testing.T) {
+	f := newSiteNameFilter([]string{"^prod-"}, []string{"-internal$"})
+	if f.allow("prod-internal") {
+		t.Fatalf("同时匹配include和exclude时，exclude应该优先")
+	}
+	if !f.allow("prod-web") {
+		t.Fatalf("只匹配include的站点应该被放行")
+	}
+}
+
+func TestSiteNameFilterIgnoresInvalidPattern(t *testing.T) {
+	f := newSiteNameFilter([]string{"("}, nil)
+	if !f.allow("anything") {
+		t.Fatalf("include列表全部编译失败时应该等价于没有include列表，放行所有站点")
+	}
+}
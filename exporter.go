@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// apiRequestStats 统计WAF API请求的成功/失败次数，用于waf_api_requests_total
+type apiRequestStats struct {
+	success int64
+	failure int64
+}
+
+func (s *apiRequestStats) record(err error) {
+	if err != nil {
+		atomic.AddInt64(&s.failure, 1)
+		return
+	}
+	atomic.AddInt64(&s.success, 1)
+}
+
+// SiteSnapshot 某一站点最新的一组流量数据，用于Prometheus导出
+type SiteSnapshot struct {
+	Site     string
+	SiteID   string
+	DeviceID string
+	Enabled  bool
+	Traffic  TrafficData
+}
+
+// Exporter 以Prometheus文本格式暴露WAFCollector采集到的数据
+type Exporter struct {
+	collector *WAFCollector
+	cacheTTL  time.Duration
+
+	mu         sync.Mutex
+	cachedAt   time.Time
+	cachedData []SiteSnapshot
+	lastUp     bool
+	lastDur    time.Duration
+}
+
+// NewExporter 创建Prometheus导出器，cacheTTL控制两次真实采集之间的最小间隔，
+// 避免Prometheus高频抓取时对WAF API造成压力
+func NewExporter(collector *WAFCollector, cacheTTL time.Duration) *Exporter {
+	return &Exporter{collector: collector, cacheTTL: cacheTTL}
+}
+
+// snapshot 返回缓存的采集结果，超过cacheTTL则触发一次真实采集
+func (e *Exporter) snapshot() ([]SiteSnapshot, bool, time.Duration) {
+	e.mu.Lock()
+	if !e.cachedAt.IsZero() && time.Since(e.cachedAt) < e.cacheTTL {
+		data, up, dur := e.cachedData, e.lastUp, e.lastDur
+		e.mu.Unlock()
+		return data, up, dur
+	}
+	e.mu.Unlock()
+
+	start := time.Now()
+	data, up := e.collector.collectTrafficSnapshot()
+	duration := time.Since(start)
+
+	e.mu.Lock()
+	e.cachedData = data
+	e.cachedAt = time.Now()
+	e.lastUp = up
+	e.lastDur = duration
+	e.mu.Unlock()
+
+	return data, up, duration
+}
+
+// ServeHTTP 实现/metrics端点，输出Prometheus文本格式
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, up, duration := e.snapshot()
+
+	var b []byte
+	appendf := func(format string, args ...interface{}) {
+		b = append(b, []byte(fmt.Sprintf(format, args...))...)
+	}
+
+	upValue := 0.0
+	if up {
+		upValue = 1.0
+	}
+	appendf("# HELP waf_collector_up WAF采集器是否可以正常访问WAF API\n# TYPE waf_collector_up gauge\nwaf_collector_up %g\n", upValue)
+	appendf("# HELP waf_collector_last_scrape_duration_seconds 最近一次采集耗时（秒）\n# TYPE waf_collector_last_scrape_duration_seconds gauge\nwaf_collector_last_scrape_duration_seconds %g\n", duration.Seconds())
+
+	stats := e.collector.apiStats
+	appendf("# HELP waf_api_requests_total WAF API请求总数，按结果分类\n# TYPE waf_api_requests_total counter\n")
+	appendf("waf_api_requests_total{result=\"success\"} %d\n", atomic.LoadInt64(&stats.success))
+	appendf("waf_api_requests_total{result=\"error\"} %d\n", atomic.LoadInt64(&stats.failure))
+
+	fields := []struct {
+		name string
+		help string
+		get  func(TrafficData) float64
+	}{
+		{"waf_site_bytes_in_rate_avg", "站点入站流量平均速率", func(t TrafficData) float64 { return t.BytesInRateAvg }},
+		{"waf_site_bytes_in_rate_max", "站点入站流量峰值速率", func(t TrafficData) float64 { return t.BytesInRateMax }},
+		{"waf_site_bytes_out_rate_avg", "站点出站流量平均速率", func(t TrafficData) float64 { return t.BytesOutRateAvg }},
+		{"waf_site_bytes_out_rate_max", "站点出站流量峰值速率", func(t TrafficData) float64 { return t.BytesOutRateMax }},
+		{"waf_site_conn_cur_avg", "站点当前并发连接数平均值", func(t TrafficData) float64 { return t.ConnCurAvg }},
+		{"waf_site_conn_cur_max", "站点当前并发连接数峰值", func(t TrafficData) float64 { return t.ConnCurMax }},
+		{"waf_site_conn_rate_avg", "站点新建连接速率平均值", func(t TrafficData) float64 { return t.ConnRateAvg }},
+		{"waf_site_http_req_cnt_avg", "站点HTTP请求数平均值", func(t TrafficData) float64 { return t.HTTPReqCntAvg }},
+		{"waf_site_http_req_cnt_max", "站点HTTP请求数峰值", func(t TrafficData) float64 { return t.HTTPReqCntMax }},
+		{"waf_site_http_req_rate_avg", "站点HTTP请求速率平均值", func(t TrafficData) float64 { return t.HTTPReqRateAvg }},
+	}
+
+	for _, field := range fields {
+		appendf("# HELP %s %s\n# TYPE %s gauge\n", field.name, field.help, field.name)
+		for _, s := range data {
+			appendf("%s{site=%q,site_id=%q,device_id=%q} %g\n", field.name, s.Site, s.SiteID, s.DeviceID, field.get(s.Traffic))
+		}
+	}
+
+	selfStats.writeTo(appendf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// runExporter 以Prometheus导出模式启动长驻HTTP服务，替代一次性采集+zabbix_sender推送的流程；
+// 同时挂载/healthz、/readyz，exporter模式下不需要额外的self-metrics监听端口
+func runExporter(collector *WAFCollector, listen string, cacheTTL time.Duration) error {
+	exporter := NewExporter(collector, cacheTTL)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	registerHealthEndpoints(mux)
+	logger.Info("以exporter模式启动", "listen", listen)
+	return http.ListenAndServe(listen, mux)
+}
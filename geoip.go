@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoInfo 一次IP地理位置查询的结果，任一字段查不到时保留空字符串
+type GeoInfo struct {
+	Country  string
+	Province string
+	City     string
+	ISP      string
+}
+
+// GeoIPResolver 基于本地GeoIP2(.mmdb)数据库的IP地理位置解析器，内置按IP的查询结果缓存，
+// 避免同一次运行中对同一个IP重复查库。国家/省份/城市来自City库；City库不含ISP字段，
+// ISP额外依赖一个单独的ASN库（asnDB非nil时才会查询）
+type GeoIPResolver struct {
+	db    *geoip2.Reader
+	asnDB *geoip2.Reader
+
+	mu    sync.Mutex
+	cache map[string]GeoInfo
+}
+
+// NewGeoIPResolver 打开指定路径的GeoIP2 City数据库，asnDBPath非空时额外打开一个
+// GeoLite2-ASN（或同结构）数据库用于补充ISP信息；asnDBPath为空时ISP始终留空
+func NewGeoIPResolver(dbPath, asnDBPath string) (*GeoIPResolver, error) {
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("打开GeoIP数据库失败: %v", err)
+	}
+
+	var asnDB *geoip2.Reader
+	if asnDBPath != "" {
+		reader, err := geoip2.Open(asnDBPath)
+		if err != nil {
+			logger.Warn("打开GeoIP ASN数据库失败，SITE_ISP将始终为空", "path", asnDBPath, "error", err)
+		} else {
+			asnDB = reader
+		}
+	}
+
+	return &GeoIPResolver{db: db, asnDB: asnDB, cache: make(map[string]GeoInfo)}, nil
+}
+
+// Lookup 查询IP对应的地理位置信息，结果按IP缓存；查询失败时返回空GeoInfo
+func (r *GeoIPResolver) Lookup(ip string) GeoInfo {
+	r.mu.Lock()
+	if info, ok := r.cache[ip]; ok {
+		r.mu.Unlock()
+		return info
+	}
+	r.mu.Unlock()
+
+	info := r.lookupUncached(ip)
+
+	r.mu.Lock()
+	r.cache[ip] = info
+	r.mu.Unlock()
+
+	return info
+}
+
+func (r *GeoIPResolver) lookupUncached(ip string) GeoInfo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoInfo{}
+	}
+
+	record, err := r.db.City(parsed)
+	if err != nil {
+		logger.Warn("GeoIP查询失败", "ip", ip, "error", err)
+		return GeoInfo{}
+	}
+
+	info := GeoInfo{
+		Country: record.Country.Names["zh-CN"],
+		City:    record.City.Names["zh-CN"],
+	}
+	if len(record.Subdivisions) > 0 {
+		info.Province = record.Subdivisions[0].Names["zh-CN"]
+	}
+	if info.Country == "" {
+		info.Country = record.Country.Names["en"]
+	}
+	if info.City == "" {
+		info.City = record.City.Names["en"]
+	}
+
+	if r.asnDB != nil {
+		if asn, err := r.asnDB.ASN(parsed); err != nil {
+			logger.Warn("GeoIP ASN查询失败", "ip", ip, "error", err)
+		} else {
+			info.ISP = asn.AutonomousSystemOrganization
+		}
+	}
+
+	return info
+}
+
+// Close 释放底层数据库文件句柄
+func (r *GeoIPResolver) Close() error {
+	if r == nil || r.db == nil {
+		return nil
+	}
+	if r.asnDB != nil {
+		r.asnDB.Close()
+	}
+	return r.db.Close()
+}
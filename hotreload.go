@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// deviceKey 用waf_host+zabbix_host组合作为一个WAF目标的身份标识，配置热加载
+// 时用它判断某个目标是新增、已被移除，还是保持不变（保持不变的目标不应该被
+// 重启，否则会丢失它正在进行中的一轮采集）
+func deviceKey(d DeviceConfig) string {
+	return d.WAFHost + "|" + d.ZabbixHost
+}
+
+// dynamicDaemon 在daemon模式下维护当前每个WAF目标的调度goroutine，并支持
+// 根据配置文件的变化动态启停目标，不需要重启整个进程
+type dynamicDaemon struct {
+	mu         sync.Mutex
+	server     ZabbixServerConfig
+	geoipDB    string
+	geoipASNDB string
+	state      *StateStore
+	cancels    map[string]context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func newDynamicDaemon(server ZabbixServerConfig, geoipDB, geoipASNDB string, state *StateStore) *dynamicDaemon {
+	return &dynamicDaemon{
+		server:     server,
+		geoipDB:    geoipDB,
+		geoipASNDB: geoipASNDB,
+		state:      state,
+		cancels:    make(map[string]context.CancelFunc),
+	}
+}
+
+// reconcile 对比当前运行中的目标和新的设备列表：停掉已被移除的目标，启动
+// 新增的目标，保留未变化目标的调度goroutine不受影响。目标只按deviceKey比较：
+// key不变而token、interval等其他字段被修改的目标不会重启，这些修改不生效；
+// zabbix_server、geoip_db等顶层配置只在创建dynamicDaemon时读取一次
+func (d *dynamicDaemon) reconcile(devices []DeviceConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wanted := make(map[string]DeviceConfig, len(devices))
+	for _, dev := range devices {
+		wanted[deviceKey(dev)] = dev
+	}
+
+	for key, cancel := range d.cancels {
+		if _, ok := wanted[key]; !ok {
+			logger.Info("配置热加载：停止WAF目标", "target", key)
+			cancel()
+			delete(d.cancels, key)
+		}
+	}
+
+	for key, dev := range wanted {
+		if _, ok := d.cancels[key]; ok {
+			continue
+		}
+		logger.Info("配置热加载：启动WAF目标", "target", key)
+		d.start(key, dev)
+	}
+}
+
+// start 为单个WAF目标创建mins/hours/days三个Collector并启动调度器；调度器
+// 运行在可独立取消的ctx上，使reconcile能只停掉这一个目标而不影响其他目标
+func (d *dynamicDaemon) start(key string, dev DeviceConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancels[key] = cancel
+
+	var tlsConfig *ZabbixTLSConfig
+	if d.server.TLSMode != "" && d.server.TLSMode != string(ZabbixTLSNone) {
+		tlsConfig = &ZabbixTLSConfig{
+			Mode:        ZabbixTLSMode(d.server.TLSMode),
+			CertFile:    d.server.TLSCert,
+			KeyFile:     d.server.TLSKey,
+			PSKIdentity: d.server.PSKID,
+			PSKKey:      d.server.PSKKey,
+		}
+	}
+
+	sender := NewZabbixSender(d.server.Address, tlsConfig)
+	sender.SetChunkSize(d.server.ChunkSize)
+
+	baseOpts := dev.toOptions(d.server, d.geoipDB, d.geoipASNDB, d.state)
+
+	// mins/hours/days三个WAFCollector共享同一个session，避免-rate-limit/
+	// -concurrency被三个数据粒度各应用一次、也避免同一个WAF目标被登录三次
+	concurrency := baseOpts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	rateLimit := baseOpts.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = concurrency * 2
+	}
+	baseOpts.Session = newWAFSession(rateLimit, baseOpts.GeoIPDBPath, baseOpts.GeoIPASNDBPath)
+
+	dataTypes := []string{"mins", "hours", "days"}
+	wafCollectors := make([]*WAFCollector, 0, len(dataTypes))
+	collectors := make([]Collector, 0, len(dataTypes))
+	for _, dataType := range dataTypes {
+		opts := baseOpts
+		opts.DataType = dataType
+		wc := NewWAFCollector(opts)
+		wafCollectors = append(wafCollectors, wc)
+		collectors = append(collectors, wc)
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		NewScheduler(sender, collectors...).Run(ctx)
+		// Run只在ctx被取消后返回，这时这一批WAFCollector已经不会再被调度，
+		// 可以安全释放它们的限流器协程和GeoIP文件句柄，否则每次reconcile
+		// 换掉一个目标都会泄漏
+		for _, wc := range wafCollectors {
+			wc.Close()
+		}
+	}()
+}
+
+// stopAll 停止所有正在运行的目标，并等待它们的调度goroutine退出，用于进程
+// 收到退出信号后的优雅关闭
+func (d *dynamicDaemon) stopAll() {
+	d.mu.Lock()
+	for key, cancel := range d.cancels {
+		cancel()
+		delete(d.cancels, key)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// runDaemonWithHotReload 以daemon模式运行initial中定义的所有WAF目标，并用
+// fsnotify监听configPath，文件发生变化时重新加载并调用reconcile，只启停
+// 新增或被移除的目标，不重启整个进程。initial由调用方传入，避免再读一次配置文件
+func runDaemonWithHotReload(configPath string, initial *Config, state *StateStore) {
+	dd := newDynamicDaemon(initial.ZabbixServer, initial.GeoIPDB, initial.GeoIPASNDB, state)
+	dd.reconcile(initial.Devices)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("创建配置文件监听器失败，配置热加载不可用", "error", err)
+	} else {
+		defer watcher.Close()
+		if err := watcher.Add(configPath); err != nil {
+			logger.Error("监听配置文件失败，配置热加载不可用", "path", configPath, "error", err)
+		} else {
+			go watchConfigChanges(watcher, configPath, dd)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("以daemon模式启动（配置文件驱动，支持热加载）", "config", configPath, "devices", len(initial.Devices))
+	<-ctx.Done()
+
+	logger.Info("daemon正在优雅退出...")
+	dd.stopAll()
+	logger.Info("daemon已退出")
+}
+
+// watchConfigChanges 监听fsnotify事件，配置文件发生写入/创建/重命名（部分
+// 编辑器保存文件时会先重命名旧文件再创建新文件，导致原inode的监听失效）时
+// 重新加载配置并触发reconcile
+func watchConfigChanges(watcher *fsnotify.Watcher, configPath string, dd *dynamicDaemon) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			// 重新Add以应对编辑器保存时替换inode的情况，否则后续事件会收不到
+			_ = watcher.Add(configPath)
+
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				logger.Error("配置热加载失败，保留当前运行中的目标", "error", err)
+				continue
+			}
+			logger.Info("检测到配置文件变化，重新加载WAF目标", "devices", len(cfg.Devices))
+			dd.reconcile(cfg.Devices)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("配置文件监听出错", "error", err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeviceKeyCombinesWAFHostAndZabbixHost(t *testing.T) {
+	dev := DeviceConfig{WAFHost: "https://waf1.example.com", ZabbixHost: "waf1"}
+	want := "https://waf1.example.com|waf1"
+	if got := deviceKey(dev); got != want {
+		t.Fatalf("deviceKey不正确: got %q, want %q", got, want)
+	}
+}
+
+func newTestDynamicDaemon(t *testing.T) *dynamicDaemon {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore返回错误: %v", err)
+	}
+	t.Cleanup(func() { state.Close() })
+
+	server := ZabbixServerConfig{Address: "127.0.0.1:1"}
+	return newDynamicDaemon(server, "", "", state)
+}
+
+// waitStopAll在独立goroutine里调用stopAll，超时说明调度goroutine没有正确退出
+func waitStopAll(t *testing.T, dd *dynamicDaemon) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		dd.stopAll()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stopAll在超时内没有返回，调度goroutine可能没有响应ctx取消")
+	}
+}
+
+func TestDynamicDaemonReconcileStartsAndStopsTargets(t *testing.T) {
+	dd := newTestDynamicDaemon(t)
+
+	dev := DeviceConfig{WAFHost: "http://127.0.0.1:1", Token: "tok", ZabbixHost: "zbx1"}
+	dd.reconcile([]DeviceConfig{dev})
+
+	dd.mu.Lock()
+	n := len(dd.cancels)
+	dd.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("reconcile新增目标后cancels应该有1条记录: got %d", n)
+	}
+
+	dd.reconcile(nil)
+
+	dd.mu.Lock()
+	n = len(dd.cancels)
+	dd.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("reconcile移除所有目标后cancels应该为空: got %d", n)
+	}
+
+	waitStopAll(t, dd)
+}
+
+func TestDynamicDaemonReconcileKeepsUnchangedTargetRunning(t *testing.T) {
+	dd := newTestDynamicDaemon(t)
+
+	dev := DeviceConfig{WAFHost: "http://127.0.0.1:1", Token: "tok", ZabbixHost: "zbx1"}
+	dd.reconcile([]DeviceConfig{dev})
+
+	dd.mu.Lock()
+	_, ok := dd.cancels[deviceKey(dev)]
+	dd.mu.Unlock()
+	if !ok {
+		t.Fatalf("目标启动后cancels应该包含它的key")
+	}
+
+	// 用完全相同的设备列表再次reconcile：目标没有变化，不应该被重启，
+	// cancels里仍然只应该有这一个key
+	dd.reconcile([]DeviceConfig{dev})
+
+	dd.mu.Lock()
+	n := len(dd.cancels)
+	_, stillOK := dd.cancels[deviceKey(dev)]
+	dd.mu.Unlock()
+	if n != 1 || !stillOK {
+		t.Fatalf("未变化的目标不应该被重启或移除: cancels数量=%d, 仍存在=%v", n, stillOK)
+	}
+
+	waitStopAll(t, dd)
+}
+
+func TestDynamicDaemonStopAllStopsMultipleTargets(t *testing.T) {
+	dd := newTestDynamicDaemon(t)
+
+	devs := []DeviceConfig{
+		{WAFHost: "http://127.0.0.1:1", Token: "tok1", ZabbixHost: "zbx1"},
+		{WAFHost: "http://127.0.0.1:1", Token: "tok2", ZabbixHost: "zbx2"},
+	}
+	dd.reconcile(devs)
+
+	dd.mu.Lock()
+	n := len(dd.cancels)
+	dd.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("应该同时有2个目标在运行: got %d", n)
+	}
+
+	waitStopAll(t, dd)
+
+	dd.mu.Lock()
+	n = len(dd.cancels)
+	dd.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("stopAll之后cancels应该清空: got %d", n)
+	}
+}
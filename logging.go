@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// appLogger 对zap.SugaredLogger的轻量封装，保留Info/Warn/Error/Debug(msg, kv...)
+// 这种此前log/slog时代的调用方式，换底层实现不必改动全部调用点
+type appLogger struct {
+	s *zap.SugaredLogger
+}
+
+func (l *appLogger) Debug(msg string, kv ...interface{}) { l.s.Debugw(msg, kv...) }
+func (l *appLogger) Info(msg string, kv ...interface{})  { l.s.Infow(msg, kv...) }
+func (l *appLogger) Warn(msg string, kv ...interface{})  { l.s.Warnw(msg, kv...) }
+func (l *appLogger) Error(msg string, kv ...interface{}) { l.s.Errorw(msg, kv...) }
+
+// With 返回附加了给定字段的新logger，用于把trace_id等字段绑定到一次run()期间
+// 产生的所有日志上
+func (l *appLogger) With(kv ...interface{}) *appLogger {
+	return &appLogger{s: l.s.With(kv...)}
+}
+
+// logger 全局结构化日志记录器，initLogging会按命令行参数重新配置
+var logger = newDefaultLogger()
+
+func newDefaultLogger() *appLogger {
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig()), zapcore.AddSync(os.Stderr), zapcore.InfoLevel)
+	return &appLogger{s: zap.New(core).Sugar()}
+}
+
+func encoderConfig() zapcore.EncoderConfig {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.TimeKey = "time"
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	return cfg
+}
+
+// logFileConfig 日志文件轮转参数，对应--log-file/--log-max-size等flag；
+// Path为空时日志只输出到stderr，不启用轮转
+type logFileConfig struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	Compress   bool
+}
+
+// initLogging 根据命令行参数重新配置全局logger；debug/quiet是旧版本遗留的布尔
+// 开关，作为别名保留：quiet等价于log-level=error，debug等价于log-level=debug。
+// format支持text/console（等价，人类可读）和json；file.Path非空时通过
+// lumberjack按大小/保留份数/保留天数轮转日志文件
+func initLogging(format, level string, quiet, debug bool, file logFileConfig) {
+	if quiet {
+		level = "error"
+	} else if debug {
+		level = "debug"
+	}
+
+	var zapLevel zapcore.Level
+	switch level {
+	case "debug":
+		zapLevel = zapcore.DebugLevel
+	case "warn":
+		zapLevel = zapcore.WarnLevel
+	case "error":
+		zapLevel = zapcore.ErrorLevel
+	default:
+		zapLevel = zapcore.InfoLevel
+	}
+
+	var encoder zapcore.Encoder
+	if format == "json" {
+		encoder = zapcore.NewJSONEncoder(encoderConfig())
+	} else {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig())
+	}
+
+	var writer zapcore.WriteSyncer
+	if file.Path != "" {
+		writer = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   file.Path,
+			MaxSize:    file.MaxSizeMB,
+			MaxBackups: file.MaxBackups,
+			MaxAge:     file.MaxAgeDays,
+			Compress:   file.Compress,
+		})
+	} else {
+		writer = zapcore.AddSync(os.Stderr)
+	}
+
+	core := zapcore.NewCore(encoder, writer, zapLevel)
+	logger = &appLogger{s: zap.New(core).Sugar()}
+}
+
+type traceIDKeyType struct{}
+
+var traceIDKey traceIDKeyType
+
+// withTraceID 把trace_id绑定到ctx上，run()在开始时调用一次，随后该ctx沿整条
+// 采集调用链传递，使同一次运行产生的所有日志都能通过trace_id关联起来
+func withTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// loggerFrom 返回绑定了ctx中trace_id（如果存在）的logger；没有trace_id时
+// 退化为全局logger
+func loggerFrom(ctx context.Context) *appLogger {
+	if traceID, ok := ctx.Value(traceIDKey).(string); ok && traceID != "" {
+		return logger.With("trace_id", traceID)
+	}
+	return logger
+}
+
+// newTraceID 生成一次run()调用的trace_id
+func newTraceID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
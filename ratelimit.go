@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// tokenBucket 一个简单的令牌桶限流器，用于限制对WAF API的请求速率
+type tokenBucket struct {
+	tokens chan struct{}
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+// newTokenBucket 创建令牌桶，ratePerSec为每秒补充的令牌数，burst为桶容量
+func newTokenBucket(ratePerSec int, burst int) *tokenBucket {
+	if ratePerSec <= 0 {
+		ratePerSec = 1
+	}
+	if burst <= 0 {
+		burst = ratePerSec
+	}
+
+	tb := &tokenBucket{
+		tokens: make(chan struct{}, burst),
+		ticker: time.NewTicker(time.Second / time.Duration(ratePerSec)),
+		done:   make(chan struct{}),
+	}
+
+	// 预填充令牌桶
+	for i := 0; i < burst; i++ {
+		tb.tokens <- struct{}{}
+	}
+
+	go tb.refill()
+
+	return tb
+}
+
+func (tb *tokenBucket) refill() {
+	for {
+		select {
+		case <-tb.ticker.C:
+			select {
+			case tb.tokens <- struct{}{}:
+			default:
+				// 桶已满，丢弃多余的令牌
+			}
+		case <-tb.done:
+			return
+		}
+	}
+}
+
+// Wait 阻塞直到获得一个令牌，或ctx被取消
+func (tb *tokenBucket) Wait(ctx context.Context) error {
+	select {
+	case <-tb.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop 停止限流器的后台补充协程
+func (tb *tokenBucket) Stop() {
+	tb.ticker.Stop()
+	close(tb.done)
+}
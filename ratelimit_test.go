@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWaitConsumesPrefilledTokens(t *testing.T) {
+	tb := newTokenBucket(1, 3)
+	defer tb.Stop()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := tb.Wait(ctx); err != nil {
+			t.Fatalf("第%d个预填充令牌获取失败: %v", i+1, err)
+		}
+	}
+}
+
+func TestTokenBucketWaitRespectsContextCancellation(t *testing.T) {
+	tb := newTokenBucket(1, 1)
+	defer tb.Stop()
+
+	ctx := context.Background()
+	if err := tb.Wait(ctx); err != nil {
+		t.Fatalf("消耗预填充令牌失败: %v", err)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := tb.Wait(cancelCtx); err == nil {
+		t.Fatalf("桶已空且ctx已取消时Wait应该返回错误")
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	tb := newTokenBucket(100, 1)
+	defer tb.Stop()
+
+	ctx := context.Background()
+	if err := tb.Wait(ctx); err != nil {
+		t.Fatalf("消耗预填充令牌失败: %v", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := tb.Wait(waitCtx); err != nil {
+		t.Fatalf("令牌桶应该在补充周期后重新放行: %v", err)
+	}
+}
+
+func TestTokenBucketStopOnceDoesNotPanic(t *testing.T) {
+	tb := newTokenBucket(1, 1)
+	tb.Stop()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// selfMetrics 采集器自身的运行指标，与WAFCollector采到的业务流量数据无关。
+// 暴露这些指标是为了让用户可以直接对"采集器本身是否存活、是否还能把数据
+// 推送到Zabbix"进行告警，而不必依赖waf.collector.status这个Zabbix监控项
+// （后者本身也要先成功推送才能被Zabbix看到，没法覆盖推送失败的情况）
+type selfMetrics struct {
+	mu                 sync.Mutex
+	collectDurationSec map[string]float64 // 按data_type记录最近一次collectAllData耗时
+	wafAPIErrorsTotal  map[string]int64   // 按endpoint累计WAF API请求失败次数
+
+	zabbixItemsSent      int64
+	zabbixItemsFailed    int64
+	lastSuccessTimestamp int64 // unix秒，0表示尚未成功推送过
+}
+
+var selfStats = &selfMetrics{
+	collectDurationSec: make(map[string]float64),
+	wafAPIErrorsTotal:  make(map[string]int64),
+}
+
+// recordCollectDuration 记录某个data_type最近一次collectAllData的耗时
+func (m *selfMetrics) recordCollectDuration(dataType string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectDurationSec[dataType] = d.Seconds()
+}
+
+// recordAPIError 累计某个endpoint的WAF API请求失败次数
+func (m *selfMetrics) recordAPIError(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wafAPIErrorsTotal[endpoint]++
+}
+
+// recordZabbixSend 在一次Send成功返回（即err==nil）后调用，累计发送/失败的
+// 数据项数量并刷新最近一次成功推送的时间戳
+func (m *selfMetrics) recordZabbixSend(sent, failed int) {
+	atomic.AddInt64(&m.zabbixItemsSent, int64(sent))
+	atomic.AddInt64(&m.zabbixItemsFailed, int64(failed))
+	atomic.StoreInt64(&m.lastSuccessTimestamp, time.Now().Unix())
+}
+
+// writeTo 把自监控指标以Prometheus文本格式追加写入，exporter模式下会和
+// 业务流量指标拼在同一份/metrics输出里，sender/daemon模式下则是独立
+// self-metrics服务的全部内容
+func (m *selfMetrics) writeTo(appendf func(format string, args ...interface{})) {
+	m.mu.Lock()
+	durations := make(map[string]float64, len(m.collectDurationSec))
+	for k, v := range m.collectDurationSec {
+		durations[k] = v
+	}
+	errs := make(map[string]int64, len(m.wafAPIErrorsTotal))
+	for k, v := range m.wafAPIErrorsTotal {
+		errs[k] = v
+	}
+	m.mu.Unlock()
+
+	appendf("# HELP zabmetrics_collect_duration_seconds 最近一次采集耗时（按数据粒度类型）\n# TYPE zabmetrics_collect_duration_seconds gauge\n")
+	for dataType, seconds := range durations {
+		appendf("zabmetrics_collect_duration_seconds{data_type=%q} %g\n", dataType, seconds)
+	}
+
+	appendf("# HELP zabmetrics_waf_api_errors_total WAF API请求失败次数（按endpoint）\n# TYPE zabmetrics_waf_api_errors_total counter\n")
+	for endpoint, count := range errs {
+		appendf("zabmetrics_waf_api_errors_total{endpoint=%q} %d\n", endpoint, count)
+	}
+
+	appendf("# HELP zabmetrics_zabbix_items_sent_total 成功推送给Zabbix server并被接受的数据项总数\n# TYPE zabmetrics_zabbix_items_sent_total counter\nzabmetrics_zabbix_items_sent_total %d\n", atomic.LoadInt64(&m.zabbixItemsSent))
+	appendf("# HELP zabmetrics_zabbix_items_failed_total 被Zabbix server拒绝的数据项总数\n# TYPE zabmetrics_zabbix_items_failed_total counter\nzabmetrics_zabbix_items_failed_total %d\n", atomic.LoadInt64(&m.zabbixItemsFailed))
+	appendf("# HELP zabmetrics_last_success_timestamp_seconds 最近一次成功推送到Zabbix的unix时间戳（秒），0表示尚未成功过\n# TYPE zabmetrics_last_success_timestamp_seconds gauge\nzabmetrics_last_success_timestamp_seconds %d\n", atomic.LoadInt64(&m.lastSuccessTimestamp))
+}
+
+// registerHealthEndpoints 把/healthz、/readyz挂到给定的mux上：/healthz只要
+// 进程在跑就返回200，用作liveness；/readyz在至少成功推送过一次之前返回503，
+// 用作readiness
+func registerHealthEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&selfStats.lastSuccessTimestamp) == 0 {
+			http.Error(w, "not ready: no successful zabbix push yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+}
+
+// selfMetricsHandler 仅输出采集器自身的自监控指标，供sender/daemon模式下
+// 独立的self-metrics服务使用（这两种模式本身不暴露业务流量数据）
+func selfMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	appendf := func(format string, args ...interface{}) {
+		b = append(b, []byte(fmt.Sprintf(format, args...))...)
+	}
+	selfStats.writeTo(appendf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// runSelfMetricsServer 启动一个独立的自监控HTTP服务，暴露/metrics(仅自监控
+// 指标)、/healthz、/readyz。sender/daemon模式下没有现成的HTTP server可以
+// 挂载这些端点，所以单独起一个；exporter模式则直接把这些端点加到它已有的mux上
+func runSelfMetricsServer(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", selfMetricsHandler)
+	registerHealthEndpoints(mux)
+	logger.Info("自监控指标服务已启动", "listen", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		logger.Error("自监控指标服务退出", "error", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// StateStore 基于SQLite的采集游标存储，替代此前按host各自维护的/tmp JSON文件。
+// 游标以(waf_host, zabbix_host, data_type, app_id)为键，这样mins/hours/days
+// 三种粒度的采集器不会互相覆盖对方的游标，单个站点的失败也只影响它自己的游标，
+// 不会拖累同一次运行里其他站点的时间范围。
+type StateStore struct {
+	db *sql.DB
+}
+
+// NewStateStore 打开（或创建）SQLite状态库并确保表结构存在。SQLite同一时间
+// 只允许一个写连接，而database/sql默认会按需开多个连接，多个并发写入会互相
+// 报SQLITE_BUSY；这里既用busy_timeout让冲突的写入互相等待而不是立即报错，
+// 又把连接池收紧到1个连接，使所有写入通过同一个连接排队执行，从根本上
+// 避免多连接争抢同一把写锁
+func NewStateStore(path string) (*StateStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("打开状态数据库失败: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	const schema = `
+CREATE TABLE IF NOT EXISTS last_run (
+	waf_host       TEXT NOT NULL,
+	zabbix_host    TEXT NOT NULL,
+	data_type      TEXT NOT NULL,
+	app_id         TEXT NOT NULL,
+	last_timestamp TEXT,
+	last_success   INTEGER NOT NULL DEFAULT 0,
+	last_error     TEXT,
+	PRIMARY KEY (waf_host, zabbix_host, data_type, app_id)
+)`
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化状态表失败: %v", err)
+	}
+
+	return &StateStore{db: db}, nil
+}
+
+// GetLastRun 查询某个站点上一次成功采集的时间，没有记录时返回nil
+func (s *StateStore) GetLastRun(wafHost, zabbixHost, dataType, appID string) (*time.Time, error) {
+	var ts string
+	err := s.db.QueryRow(
+		`SELECT last_timestamp FROM last_run WHERE waf_host = ? AND zabbix_host = ? AND data_type = ? AND app_id = ? AND last_success = 1`,
+		wafHost, zabbixHost, dataType, appID,
+	).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询游标失败: %v", err)
+	}
+
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return nil, fmt.Errorf("解析游标时间失败: %v", err)
+	}
+	return &t, nil
+}
+
+// SaveLastRun 记录某个站点本次成功采集的时间，推进其游标
+func (s *StateStore) SaveLastRun(wafHost, zabbixHost, dataType, appID string, runTime time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO last_run (waf_host, zabbix_host, data_type, app_id, last_timestamp, last_success, last_error)
+		 VALUES (?, ?, ?, ?, ?, 1, NULL)
+		 ON CONFLICT(waf_host, zabbix_host, data_type, app_id)
+		 DO UPDATE SET last_timestamp = excluded.last_timestamp, last_success = 1, last_error = NULL`,
+		wafHost, zabbixHost, dataType, appID, runTime.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("保存游标失败: %v", err)
+	}
+	return nil
+}
+
+// SaveError 记录某个站点本次采集失败的原因，但不移动该站点的游标，
+// 使其下次运行仍从自己上一次成功的时间点重试
+func (s *StateStore) SaveError(wafHost, zabbixHost, dataType, appID, errMsg string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO last_run (waf_host, zabbix_host, data_type, app_id, last_timestamp, last_success, last_error)
+		 VALUES (?, ?, ?, ?, NULL, 0, ?)
+		 ON CONFLICT(waf_host, zabbix_host, data_type, app_id)
+		 DO UPDATE SET last_error = excluded.last_error`,
+		wafHost, zabbixHost, dataType, appID, errMsg,
+	)
+	if err != nil {
+		return fmt.Errorf("保存采集错误失败: %v", err)
+	}
+	return nil
+}
+
+// Close 关闭底层数据库连接
+func (s *StateStore) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
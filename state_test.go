@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestStateStore(t *testing.T) *StateStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore返回错误: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStateStoreGetLastRunWithoutRecord(t *testing.T) {
+	store := newTestStateStore(t)
+
+	got, err := store.GetLastRun("waf1", "zbx1", "mins", "site1")
+	if err != nil {
+		t.Fatalf("GetLastRun返回错误: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("没有记录时应该返回nil, got %v", got)
+	}
+}
+
+func TestStateStoreSaveAndGetLastRun(t *testing.T) {
+	store := newTestStateStore(t)
+
+	runTime := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.SaveLastRun("waf1", "zbx1", "mins", "site1", runTime); err != nil {
+		t.Fatalf("SaveLastRun返回错误: %v", err)
+	}
+
+	got, err := store.GetLastRun("waf1", "zbx1", "mins", "site1")
+	if err != nil {
+		t.Fatalf("GetLastRun返回错误: %v", err)
+	}
+	if got == nil {
+		t.Fatalf("保存后应该能查到游标")
+	}
+	if !got.Equal(runTime) {
+		t.Fatalf("游标时间不一致: got %v, want %v", got, runTime)
+	}
+}
+
+func TestStateStoreCursorsAreIsolatedByDataType(t *testing.T) {
+	store := newTestStateStore(t)
+
+	minsTime := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	hoursTime := time.Date(2026, 7, 1, 6, 0, 0, 0, time.UTC)
+
+	if err := store.SaveLastRun("waf1", "zbx1", "mins", "site1", minsTime); err != nil {
+		t.Fatalf("保存mins游标失败: %v", err)
+	}
+	if err := store.SaveLastRun("waf1", "zbx1", "hours", "site1", hoursTime); err != nil {
+		t.Fatalf("保存hours游标失败: %v", err)
+	}
+
+	gotMins, err := store.GetLastRun("waf1", "zbx1", "mins", "site1")
+	if err != nil || gotMins == nil || !gotMins.Equal(minsTime) {
+		t.Fatalf("mins游标被hours覆盖: got %v, err %v", gotMins, err)
+	}
+	gotHours, err := store.GetLastRun("waf1", "zbx1", "hours", "site1")
+	if err != nil || gotHours == nil || !gotHours.Equal(hoursTime) {
+		t.Fatalf("hours游标不正确: got %v, err %v", gotHours, err)
+	}
+}
+
+// TestStateStoreConcurrentSaveLastRun重现-concurrency worker pool每次tick
+// 对同一个StateStore并发写入的场景：30个goroutine各自给不同站点推进游标，
+// 任何一个SaveLastRun返回SQLITE_BUSY都说明连接池/锁配置又退化了
+func TestStateStoreConcurrentSaveLastRun(t *testing.T) {
+	store := newTestStateStore(t)
+
+	const goroutines = 30
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	runTime := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			appID := fmt.Sprintf("site%d", i)
+			errs[i] = store.SaveLastRun("waf1", "zbx1", "mins", appID, runTime)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("goroutine %d的SaveLastRun返回错误: %v", i, err)
+		}
+	}
+
+	for i := 0; i < goroutines; i++ {
+		appID := fmt.Sprintf("site%d", i)
+		got, err := store.GetLastRun("waf1", "zbx1", "mins", appID)
+		if err != nil {
+			t.Fatalf("GetLastRun(%s)返回错误: %v", appID, err)
+		}
+		if got == nil || !got.Equal(runTime) {
+			t.Fatalf("%s的游标未正确推进: got %v", appID, got)
+		}
+	}
+}
+
+func TestStateStoreSaveErrorDoesNotAdvanceCursor(t *testing.T) {
+	store := newTestStateStore(t)
+
+	runTime := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.SaveLastRun("waf1", "zbx1", "mins", "site1", runTime); err != nil {
+		t.Fatalf("SaveLastRun返回错误: %v", err)
+	}
+	if err := store.SaveError("waf1", "zbx1", "mins", "site1", "boom"); err != nil {
+		t.Fatalf("SaveError返回错误: %v", err)
+	}
+
+	got, err := store.GetLastRun("waf1", "zbx1", "mins", "site1")
+	if err != nil {
+		t.Fatalf("GetLastRun返回错误: %v", err)
+	}
+	if got == nil || !got.Equal(runTime) {
+		t.Fatalf("失败的采集不应该移动游标: got %v", got)
+	}
+}
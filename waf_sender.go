@@ -1,33 +1,89 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 // WAFCollector WAF数据采集器
 type WAFCollector struct {
-	wafHost        string
-	token          string
-	zabbixServer   string
-	zabbixHost     string
-	dataType       string
-	client         *http.Client
+	wafHost      string
+	token        string
+	zabbixServer string
+	zabbixHost   string
+	dataType     string
+	client       *http.Client
+	state        *StateStore
+	sender       *ZabbixSender
+	session      *wafSession // 限流器、登录态、设备ID/站点缓存；同一设备的mins/hours/days三个采集器共享同一个session
+
+	concurrency int // 并发采集站点数
+	siteTimeout time.Duration
+	apiStats    *apiRequestStats
+	siteFilter  *siteNameFilter
+	interval    time.Duration // daemon模式下的采集周期，0表示按dataType使用默认值
+}
+
+// wafSession 是同一个WAF设备的限流器、登录态和设备ID/站点缓存。daemon模式下
+// 一个设备会按mins/hours/days建立三个WAFCollector，如果各自持有一份这些状态，
+// 相当于把用户配置的-rate-limit/-concurrency应用了三次，且要对同一个WAF连续
+// 登录三次；把这些状态收敛到一个session里、由三个WAFCollector共享，
+// 采集频率和登录次数才真正符合用户的配置
+type wafSession struct {
+	mu             sync.Mutex
+	loggedIn       bool   // 连接验证是否已经成功过一次
+	cachedDeviceID string // 同一设备的device_id只需要获取一次
 	cachedSites    []Site
-	cachedDeviceID string
-	lastRunFile    string
+
+	limiter     *tokenBucket
+	geoResolver *GeoIPResolver
+	closeOnce   sync.Once
+}
+
+// newWAFSession 按rateLimit创建限流器，geoipDBPath非空时加载GeoIP数据库（geoipASNDBPath
+// 额外非空时一并加载ASN数据库用于补充ISP信息）；这些都只需要为一个WAF设备创建一份，
+// 不随数据粒度的数量增加
+func newWAFSession(rateLimit int, geoipDBPath, geoipASNDBPath string) *wafSession {
+	var geoResolver *GeoIPResolver
+	if geoipDBPath != "" {
+		resolver, err := NewGeoIPResolver(geoipDBPath, geoipASNDBPath)
+		if err != nil {
+			logger.Warn("加载GeoIP数据库失败，站点地理位置信息将为空", "path", geoipDBPath, "error", err)
+		} else {
+			geoResolver = resolver
+		}
+	}
+
+	return &wafSession{
+		limiter:     newTokenBucket(rateLimit, rateLimit),
+		geoResolver: geoResolver,
+	}
+}
+
+// Close 释放session持有的后台资源（限流器的补充协程、GeoIP数据库文件句柄）。
+// 多个WAFCollector共享同一个session时，每个WAFCollector.Close()都会调用
+// 这个方法，closeOnce确保限流器的ticker/channel只被真正关闭一次
+func (s *wafSession) Close() {
+	s.closeOnce.Do(func() {
+		if s.limiter != nil {
+			s.limiter.Stop()
+		}
+		if s.geoResolver != nil {
+			if err := s.geoResolver.Close(); err != nil {
+				logger.Warn("关闭GeoIP数据库失败", "error", err)
+			}
+		}
+	})
 }
 
 // Site 站点信息
@@ -36,6 +92,9 @@ type Site struct {
 	Name     string `json:"name"`
 	Enabled  bool   `json:"enabled"`
 	StructID string `json:"struct_id"`
+	IP       string `json:"ip"`
+	Port     string `json:"port"`
+	Domain   string `json:"domain"`
 }
 
 // TrafficData 流量数据
@@ -59,13 +118,7 @@ type ZabbixData struct {
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
 	Clock int64       `json:"clock"`
-}
-
-// LastRunInfo 上次运行信息
-type LastRunInfo struct {
-	LastRunTime string `json:"last_run_time"`
-	DataType    string `json:"data_type"`
-	ZabbixHost  string `json:"zabbix_host"`
+	Ns    int64       `json:"ns,omitempty"`
 }
 
 // APIResponse 通用API响应结构
@@ -75,8 +128,29 @@ type APIResponse struct {
 	Data    json.RawMessage `json:"data"`
 }
 
-// NewWAFCollector 创建WAF采集器
-func NewWAFCollector(wafHost, token, zabbixServer, zabbixHost, dataType string) *WAFCollector {
+// WAFCollectorOptions 创建WAFCollector所需的全部参数；命令行flag和配置文件两种模式
+// 最终都汇聚成这个结构体，避免NewWAFCollector的参数列表无限增长
+type WAFCollectorOptions struct {
+	WAFHost        string
+	Token          string
+	ZabbixServer   string
+	ZabbixHost     string
+	DataType       string
+	ZabbixTLS      *ZabbixTLSConfig
+	ChunkSize      int
+	Concurrency    int
+	RateLimit      int
+	SiteFilter     *siteNameFilter
+	GeoIPDBPath    string
+	GeoIPASNDBPath string // GeoIP ASN(.mmdb)数据库路径，用于补充City库不含的ISP信息；为空时SITE_ISP始终为空
+	State          *StateStore
+	Interval       time.Duration // daemon模式下覆盖按DataType推算的默认采集周期，0表示不覆盖
+	Session        *wafSession   // 多个数据粒度共享同一个WAF设备的限流器/登录态/站点缓存时传入；
+	// 为nil时NewWAFCollector会按RateLimit/GeoIPDBPath创建一个只属于自己的session
+}
+
+// NewWAFCollector 根据opts创建WAF采集器
+func NewWAFCollector(opts WAFCollectorOptions) *WAFCollector {
 	// 创建HTTP客户端，忽略SSL证书验证
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -86,26 +160,70 @@ func NewWAFCollector(wafHost, token, zabbixServer, zabbixHost, dataType string)
 		Timeout:   30 * time.Second,
 	}
 
-	// 生成上次运行时间文件路径
-	safeHost := strings.ReplaceAll(zabbixHost, "/", "_")
-	lastRunFile := filepath.Join("/tmp", fmt.Sprintf("waf_sender_last_run_%s.json", safeHost))
+	sender := NewZabbixSender(opts.ZabbixServer, opts.ZabbixTLS)
+	sender.SetChunkSize(opts.ChunkSize)
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	session := opts.Session
+	if session == nil {
+		rateLimit := opts.RateLimit
+		if rateLimit <= 0 {
+			rateLimit = concurrency * 2
+		}
+		session = newWAFSession(rateLimit, opts.GeoIPDBPath, opts.GeoIPASNDBPath)
+	}
 
 	return &WAFCollector{
-		wafHost:      strings.TrimRight(wafHost, "/"),
-		token:        token,
-		zabbixServer: zabbixServer,
-		zabbixHost:   zabbixHost,
-		dataType:     dataType,
+		wafHost:      strings.TrimRight(opts.WAFHost, "/"),
+		token:        opts.Token,
+		zabbixServer: opts.ZabbixServer,
+		zabbixHost:   opts.ZabbixHost,
+		dataType:     opts.DataType,
 		client:       client,
-		lastRunFile:  lastRunFile,
+		state:        opts.State,
+		sender:       sender,
+		session:      session,
+		concurrency:  concurrency,
+		siteTimeout:  30 * time.Second,
+		apiStats:     &apiRequestStats{},
+		siteFilter:   opts.SiteFilter,
+		interval:     opts.Interval,
 	}
 }
 
+// Close 释放采集器所用session持有的后台资源（限流器的补充协程、GeoIP数据库
+// 文件句柄）。一次性的命令行/daemon模式下进程退出即回收，不需要调用；
+// config热加载动态创建/销毁WAFCollector时必须调用，否则每次reconcile都会
+// 泄漏。多个WAFCollector共享同一个session时可以各自调用，session.Close()
+// 内部去重，不会重复关闭
+func (w *WAFCollector) Close() {
+	w.session.Close()
+}
+
 // doRequest 执行HTTP请求
 func (w *WAFCollector) doRequest(method, path string, params map[string]string) (*APIResponse, error) {
+	return w.doRequestContext(context.Background(), method, path, params)
+}
+
+// doRequestContext 执行受ctx控制的HTTP请求，请求前会等待限流器放行
+func (w *WAFCollector) doRequestContext(ctx context.Context, method, path string, params map[string]string) (resp *APIResponse, err error) {
+	if w.apiStats != nil {
+		defer func() { w.apiStats.record(err) }()
+	}
+
+	if w.session.limiter != nil {
+		if err := w.session.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("等待限流令牌失败: %v", err)
+		}
+	}
+
 	url := fmt.Sprintf("%s%s", w.wafHost, path)
-	
-	req, err := http.NewRequest(method, url, nil)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -124,27 +242,41 @@ func (w *WAFCollector) doRequest(method, path string, params map[string]string)
 		req.URL.RawQuery = q.Encode()
 	}
 
-	resp, err := w.client.Do(req)
+	start := time.Now()
+	httpResp, err := w.client.Do(req)
 	if err != nil {
+		selfStats.recordAPIError(path)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer httpResp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(httpResp.Body)
 	if err != nil {
+		selfStats.recordAPIError(path)
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP错误: %d, 响应: %s", resp.StatusCode, string(body))
+	loggerFrom(ctx).Debug("WAF API请求完成",
+		"waf_host", w.wafHost,
+		"endpoint", path,
+		"status", httpResp.StatusCode,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"bytes", len(body),
+	)
+
+	if httpResp.StatusCode != http.StatusOK {
+		selfStats.recordAPIError(path)
+		return nil, fmt.Errorf("HTTP错误: %d, 响应: %s", httpResp.StatusCode, string(body))
 	}
 
 	var apiResp APIResponse
 	if err := json.Unmarshal(body, &apiResp); err != nil {
+		selfStats.recordAPIError(path)
 		return nil, fmt.Errorf("解析响应失败: %v", err)
 	}
 
 	if apiResp.Code != "SUCCESS" {
+		selfStats.recordAPIError(path)
 		return nil, fmt.Errorf("API错误: %s", apiResp.Message)
 	}
 
@@ -153,28 +285,62 @@ func (w *WAFCollector) doRequest(method, path string, params map[string]string)
 
 // login 验证连接
 func (w *WAFCollector) login() bool {
-	_, err := w.doRequest("GET", "/api/v1/device/name/", nil)
+	return w.loginContext(context.Background())
+}
+
+// loginContext 验证连接（支持ctx取消）
+func (w *WAFCollector) loginContext(ctx context.Context) bool {
+	_, err := w.doRequestContext(ctx, "GET", "/api/v1/device/name/", nil)
 	if err != nil {
-		log.Printf("WAF连接验证失败: %v", err)
+		loggerFrom(ctx).Error("WAF连接验证失败", "error", err)
+		return false
+	}
+	loggerFrom(ctx).Info("WAF连接验证成功")
+	return true
+}
+
+// ensureLoggedIn 只在第一次调用时真正验证连接，此后直接复用结果，
+// daemon模式下每个数据粒度的Collector每次tick都会调collectAllData，
+// 不应该对同一个WAFCollector反复发起连接验证请求
+func (w *WAFCollector) ensureLoggedIn(ctx context.Context) bool {
+	w.session.mu.Lock()
+	if w.session.loggedIn {
+		w.session.mu.Unlock()
+		return true
+	}
+	w.session.mu.Unlock()
+
+	if !w.loginContext(ctx) {
 		return false
 	}
-	log.Println("WAF连接验证成功")
+
+	w.session.mu.Lock()
+	w.session.loggedIn = true
+	w.session.mu.Unlock()
 	return true
 }
 
 // getDeviceID 获取设备ID
 func (w *WAFCollector) getDeviceID() string {
-	if w.cachedDeviceID != "" {
-		return w.cachedDeviceID
+	return w.getDeviceIDContext(context.Background())
+}
+
+// getDeviceIDContext 获取设备ID（支持ctx取消），cachedDeviceID受mu保护以便并发安全访问
+func (w *WAFCollector) getDeviceIDContext(ctx context.Context) string {
+	w.session.mu.Lock()
+	if w.session.cachedDeviceID != "" {
+		defer w.session.mu.Unlock()
+		return w.session.cachedDeviceID
 	}
+	w.session.mu.Unlock()
 
 	params := map[string]string{
 		"_ts": fmt.Sprintf("%d", time.Now().UnixMilli()),
 	}
 
-	resp, err := w.doRequest("GET", "/api/v1/device/name/", params)
+	resp, err := w.doRequestContext(ctx, "GET", "/api/v1/device/name/", params)
 	if err != nil {
-		log.Printf("获取设备ID失败: %v", err)
+		loggerFrom(ctx).Error("获取设备ID失败", "error", err)
 		return ""
 	}
 
@@ -182,18 +348,24 @@ func (w *WAFCollector) getDeviceID() string {
 		ID string `json:"id"`
 	}
 	if err := json.Unmarshal(resp.Data, &deviceInfo); err != nil {
-		log.Printf("解析设备信息失败: %v", err)
+		loggerFrom(ctx).Error("解析设备信息失败", "error", err)
 		return ""
 	}
 
-	w.cachedDeviceID = deviceInfo.ID
-	log.Printf("获取到设备ID: %s", w.cachedDeviceID)
-	return w.cachedDeviceID
+	w.session.mu.Lock()
+	w.session.cachedDeviceID = deviceInfo.ID
+	w.session.mu.Unlock()
+	loggerFrom(ctx).Info("获取到设备ID", "device_id", deviceInfo.ID)
+	return deviceInfo.ID
 }
 
 // getDeviceSerial 获取设备序列号作为备用device_id
 func (w *WAFCollector) getDeviceSerial() string {
-	resp, err := w.doRequest("GET", "/api/v1/device/info/", nil)
+	return w.getDeviceSerialContext(context.Background())
+}
+
+func (w *WAFCollector) getDeviceSerialContext(ctx context.Context) string {
+	resp, err := w.doRequestContext(ctx, "GET", "/api/v1/device/info/", nil)
 	if err != nil {
 		return ""
 	}
@@ -210,15 +382,20 @@ func (w *WAFCollector) getDeviceSerial() string {
 
 // getSites 获取所有站点信息
 func (w *WAFCollector) getSites() []Site {
+	return w.getSitesContext(context.Background())
+}
+
+// getSitesContext 获取所有站点信息（支持ctx取消）
+func (w *WAFCollector) getSitesContext(ctx context.Context) []Site {
 	params := map[string]string{
 		"page":     "1",
 		"per_page": "1000",
 		"_ts":      fmt.Sprintf("%d", time.Now().UnixMilli()),
 	}
 
-	resp, err := w.doRequest("GET", "/api/v1/website/site/", params)
+	resp, err := w.doRequestContext(ctx, "GET", "/api/v1/website/site/", params)
 	if err != nil {
-		log.Printf("获取站点列表失败: %v", err)
+		loggerFrom(ctx).Error("获取站点列表失败", "error", err)
 		return nil
 	}
 
@@ -228,115 +405,89 @@ func (w *WAFCollector) getSites() []Site {
 			Name     string `json:"name"`
 			Enable   bool   `json:"enable"`
 			StructPK string `json:"struct_pk"`
+			OriginIP string `json:"origin_ip"`
+			Port     string `json:"port"`
+			Domain   string `json:"domain"`
 		} `json:"result"`
 	}
 
 	if err := json.Unmarshal(resp.Data, &siteData); err != nil {
-		log.Printf("解析站点数据失败: %v", err)
+		loggerFrom(ctx).Error("解析站点数据失败", "error", err)
 		return nil
 	}
 
 	sites := make([]Site, 0, len(siteData.Result))
 	for _, s := range siteData.Result {
+		if w.siteFilter != nil && !w.siteFilter.allow(s.Name) {
+			continue
+		}
 		sites = append(sites, Site{
 			ID:       s.PK,
 			Name:     s.Name,
 			Enabled:  s.Enable,
 			StructID: s.StructPK,
+			IP:       s.OriginIP,
+			Port:     s.Port,
+			Domain:   s.Domain,
 		})
 	}
 
-	log.Printf("发现 %d 个站点", len(sites))
-	w.cachedSites = sites
+	loggerFrom(ctx).Info("发现站点", "count", len(sites))
+	w.session.mu.Lock()
+	w.session.cachedSites = sites
+	w.session.mu.Unlock()
 	return sites
 }
 
-// getLastRunTime 获取上次运行时间
-func (w *WAFCollector) getLastRunTime() *time.Time {
-	data, err := os.ReadFile(w.lastRunFile)
+// getLastRunTime 获取指定站点(app_id)上次成功采集的时间，游标按
+// (waf_host, zabbix_host, data_type, app_id)独立存储，互不覆盖
+func (w *WAFCollector) getLastRunTime(ctx context.Context, appID string) *time.Time {
+	t, err := w.state.GetLastRun(w.wafHost, w.zabbixHost, w.dataType, appID)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("读取上次运行时间文件失败: %v", err)
-		}
+		loggerFrom(ctx).Error("读取上次运行时间失败", "app_id", appID, "error", err)
 		return nil
 	}
-
-	var info LastRunInfo
-	if err := json.Unmarshal(data, &info); err != nil {
-		log.Printf("解析上次运行时间失败: %v", err)
+	if t == nil {
 		return nil
 	}
 
-	// 兼容多种时间格式（参考Python版本）
-	var t time.Time
-	var parseErr error
-	
-	// 尝试RFC3339格式 (2006-01-02T15:04:05Z07:00)
-	t, parseErr = time.Parse(time.RFC3339, info.LastRunTime)
-	if parseErr != nil {
-		// 尝试ISO格式带微秒 (2006-01-02T15:04:05.999999)
-		t, parseErr = time.Parse("2006-01-02T15:04:05.999999", info.LastRunTime)
-		if parseErr != nil {
-			// 尝试ISO格式不带微秒 (2006-01-02T15:04:05)
-			t, parseErr = time.Parse("2006-01-02T15:04:05", info.LastRunTime)
-			if parseErr != nil {
-				// 尝试普通格式 (2006-01-02 15:04:05)
-				t, parseErr = time.Parse("2006-01-02 15:04:05", info.LastRunTime)
-				if parseErr != nil {
-					log.Printf("解析时间格式失败: %v", parseErr)
-					return nil
-				}
-			}
-		}
-	}
-
-	log.Printf("读取到上次运行时间: %s", t.Format("2006-01-02 15:04:05"))
-	return &t
+	loggerFrom(ctx).Info("读取到上次运行时间", "app_id", appID, "last_run_time", t.Format("2006-01-02 15:04:05"))
+	return t
 }
 
-// saveLastRunTime 保存本次运行时间
-func (w *WAFCollector) saveLastRunTime(runTime time.Time) {
-	info := LastRunInfo{
-		LastRunTime: runTime.Format(time.RFC3339),
-		DataType:    w.dataType,
-		ZabbixHost:  w.zabbixHost,
-	}
-
-	data, err := json.MarshalIndent(info, "", "  ")
-	if err != nil {
-		log.Printf("序列化运行时间失败: %v", err)
-		return
-	}
-
-	if err := os.WriteFile(w.lastRunFile, data, 0644); err != nil {
-		log.Printf("保存运行时间失败: %v", err)
-		return
+// saveLastRunTime 推进指定站点(app_id)的游标
+func (w *WAFCollector) saveLastRunTime(ctx context.Context, appID string, runTime time.Time) {
+	if err := w.state.SaveLastRun(w.wafHost, w.zabbixHost, w.dataType, appID, runTime); err != nil {
+		loggerFrom(ctx).Error("保存运行时间失败", "app_id", appID, "error", err)
 	}
 }
 
 // findWorkingDeviceID 智能查找可用的device_id
-func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) string {
+func (w *WAFCollector) findWorkingDeviceID(ctx context.Context, appID, originalDeviceID string) string {
 	// 处理"0"、"auto"或空值的情况
 	if originalDeviceID == "" || originalDeviceID == "0" || originalDeviceID == "auto" {
-		realDeviceID := w.getDeviceID()
+		realDeviceID := w.getDeviceIDContext(ctx)
 		if realDeviceID != "" {
-			log.Printf("站点 %s 的device_id是'%s'，使用真实设备ID: %s", appID, originalDeviceID, realDeviceID)
+			loggerFrom(ctx).Info("使用真实设备ID替换占位device_id", "app_id", appID, "original_device_id", originalDeviceID, "device_id", realDeviceID)
 			return realDeviceID
 		}
 	}
 
 	// 尝试使用原始device_id
-	if w.tryGetData(appID, originalDeviceID) {
+	if w.tryGetData(ctx, appID, originalDeviceID) {
 		return originalDeviceID
 	}
 
 	// 尝试其他方法查找
-	log.Printf("原始device_id %s 未返回有效数据，尝试其他方法...", originalDeviceID)
+	loggerFrom(ctx).Info("原始device_id未返回有效数据，尝试其他方法", "original_device_id", originalDeviceID)
 
 	// 方法1：从站点列表查找struct_pk
-	for _, site := range w.cachedSites {
+	w.session.mu.Lock()
+	cachedSites := w.session.cachedSites
+	w.session.mu.Unlock()
+	for _, site := range cachedSites {
 		if site.ID == appID && site.StructID != "" && site.StructID != originalDeviceID && site.StructID != "0" {
-			if w.tryGetData(appID, site.StructID) {
+			if w.tryGetData(ctx, appID, site.StructID) {
 				return site.StructID
 			}
 			break
@@ -344,9 +495,9 @@ func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) strin
 	}
 
 	// 方法2：尝试从设备名称接口获取UUID格式的device_id
-	realDeviceID := w.getDeviceID()
+	realDeviceID := w.getDeviceIDContext(ctx)
 	if realDeviceID != "" && realDeviceID != originalDeviceID {
-		if w.tryGetData(appID, realDeviceID) {
+		if w.tryGetData(ctx, appID, realDeviceID) {
 			return realDeviceID
 		}
 	}
@@ -355,7 +506,7 @@ func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) strin
 	siteTypes := []string{"reverse", "transparent", "traction", "sniffer", "bridge"}
 	for _, siteType := range siteTypes {
 		treeURL := fmt.Sprintf("/api/v1/website/tree/%s/", siteType)
-		resp, err := w.doRequest("GET", treeURL, nil)
+		resp, err := w.doRequestContext(ctx, "GET", treeURL, nil)
 		if err != nil {
 			continue
 		}
@@ -376,8 +527,8 @@ func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) strin
 									if clusterMap, ok := cluster.(map[string]interface{}); ok {
 										if clusterID, ok := clusterMap["_pk"].(string); ok {
 											if clusterID != "" && clusterID != "0" && clusterID != "1" && clusterID != originalDeviceID {
-												if w.tryGetData(appID, clusterID) {
-													log.Printf("成功使用集群ID: %s", clusterID)
+												if w.tryGetData(ctx, appID, clusterID) {
+													loggerFrom(ctx).Info("成功使用集群ID", "cluster_id", clusterID)
 													return clusterID
 												}
 											}
@@ -393,10 +544,10 @@ func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) strin
 	}
 
 	// 方法4：最后尝试使用设备序列号作为备用（参考waf_traffic_collector.py）
-	deviceSerial := w.getDeviceSerial()
+	deviceSerial := w.getDeviceSerialContext(ctx)
 	if deviceSerial != "" && deviceSerial != originalDeviceID {
-		log.Printf("尝试使用设备序列号: %s", deviceSerial)
-		if w.tryGetData(appID, deviceSerial) {
+		loggerFrom(ctx).Info("尝试使用设备序列号", "device_serial", deviceSerial)
+		if w.tryGetData(ctx, appID, deviceSerial) {
 			return deviceSerial
 		}
 	}
@@ -405,7 +556,7 @@ func (w *WAFCollector) findWorkingDeviceID(appID, originalDeviceID string) strin
 }
 
 // tryGetData 尝试使用指定的device_id获取数据
-func (w *WAFCollector) tryGetData(appID, deviceID string) bool {
+func (w *WAFCollector) tryGetData(ctx context.Context, appID, deviceID string) bool {
 	params := map[string]string{
 		"type":      "mins",
 		"app_id":    appID,
@@ -413,7 +564,7 @@ func (w *WAFCollector) tryGetData(appID, deviceID string) bool {
 		"_ts":       fmt.Sprintf("%d", time.Now().UnixMilli()),
 	}
 
-	resp, err := w.doRequest("GET", "/api/v1/logs/traffic/", params)
+	resp, err := w.doRequestContext(ctx, "GET", "/api/v1/logs/traffic/", params)
 	if err != nil {
 		return false
 	}
@@ -438,38 +589,39 @@ func (w *WAFCollector) tryGetData(appID, deviceID string) bool {
 	return false
 }
 
-// getTrafficData 获取站点流量数据
-func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
+// getTrafficData 获取站点流量数据，ctx用于对单个站点的采集设置超时。
+// 返回的error仅反映本次API调用是否成功，调用方据此决定是否推进该站点的游标
+func (w *WAFCollector) getTrafficData(ctx context.Context, appID, deviceID string) ([]TrafficData, error) {
 	// 智能查找有效的device_id
-	workingDeviceID := w.findWorkingDeviceID(appID, deviceID)
+	workingDeviceID := w.findWorkingDeviceID(ctx, appID, deviceID)
 
 	// 确定时间范围
 	endTime := time.Now()
 	var startTime time.Time
 
-	lastRunTime := w.getLastRunTime()
+	lastRunTime := w.getLastRunTime(ctx, appID)
 	if lastRunTime != nil {
 		startTime = *lastRunTime
-		
+
 		// 限制最大时间范围
 		maxRanges := map[string]time.Duration{
 			"mins":  24 * time.Hour,
 			"hours": 7 * 24 * time.Hour,
 			"days":  30 * 24 * time.Hour,
 		}
-		
+
 		maxRange := maxRanges[w.dataType]
 		if maxRange == 0 {
 			maxRange = 24 * time.Hour
 		}
-		
+
 		minStartTime := endTime.Add(-maxRange)
 		if startTime.Before(minStartTime) {
-			log.Printf("时间范围太大，限制为最近 %v", maxRange)
+			loggerFrom(ctx).Info("时间范围太大，已限制", "max_range", maxRange.String())
 			startTime = minStartTime
 		}
-		
-		log.Printf("从上次运行时间获取数据: %s", lastRunTime.Format("2006-01-02 15:04:05"))
+
+		loggerFrom(ctx).Info("从上次运行时间获取数据", "last_run_time", lastRunTime.Format("2006-01-02 15:04:05"))
 	} else {
 		// 首次运行，根据数据类型确定时间窗口
 		timeWindows := map[string]time.Duration{
@@ -477,14 +629,14 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 			"hours": 2 * time.Hour,
 			"days":  2 * 24 * time.Hour,
 		}
-		
+
 		timeWindow := timeWindows[w.dataType]
 		if timeWindow == 0 {
 			timeWindow = 5 * time.Minute
 		}
-		
+
 		startTime = endTime.Add(-timeWindow)
-		log.Printf("首次运行，获取最近 %v 的数据", timeWindow)
+		loggerFrom(ctx).Info("首次运行，按默认窗口获取数据", "time_window", timeWindow.String())
 	}
 
 	// 请求参数
@@ -497,12 +649,18 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 		"_ts":           fmt.Sprintf("%d", time.Now().UnixMilli()),
 	}
 
-	log.Printf("请求流量数据，时间范围: %s 到 %s", startTime.Format("2006-01-02 15:04:05"), endTime.Format("2006-01-02 15:04:05"))
+	loggerFrom(ctx).Info("请求流量数据",
+		"app_id", appID,
+		"device_id", workingDeviceID,
+		"data_type", w.dataType,
+		"start_time", startTime.Format("2006-01-02 15:04:05"),
+		"end_time", endTime.Format("2006-01-02 15:04:05"),
+	)
 
-	resp, err := w.doRequest("GET", "/api/v1/logs/traffic/", params)
+	resp, err := w.doRequestContext(ctx, "GET", "/api/v1/logs/traffic/", params)
 	if err != nil {
-		log.Printf("获取流量数据失败 (app_id=%s): %v", appID, err)
-		return []TrafficData{{Timestamp: time.Now().Unix()}}
+		loggerFrom(ctx).Error("获取流量数据失败", "app_id", appID, "error", err)
+		return []TrafficData{{Timestamp: time.Now().Unix()}}, err
 	}
 
 	var trafficResp struct {
@@ -510,12 +668,12 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 	}
 
 	if err := json.Unmarshal(resp.Data, &trafficResp); err != nil {
-		log.Printf("解析流量数据失败: %v", err)
-		return []TrafficData{{Timestamp: time.Now().Unix()}}
+		loggerFrom(ctx).Error("解析流量数据失败", "error", err)
+		return []TrafficData{{Timestamp: time.Now().Unix()}}, err
 	}
 
 	dataPoints := make([]TrafficData, 0)
-	
+
 	for _, record := range trafficResp.Result {
 		// 检查是否有有效数据
 		validData := false
@@ -557,25 +715,25 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 			HTTPReqCntMax:   getFloatValue(record, "http_req_cnt_max"),
 			HTTPReqRateAvg:  getFloatValue(record, "http_req_rate_avg"),
 		}
-		
+
 		dataPoints = append(dataPoints, dataPoint)
 	}
 
 	if len(dataPoints) > 0 {
-		log.Printf("站点 %s 使用数据类型 '%s' 获取到 %d 个有效数据点", appID, w.dataType, len(dataPoints))
-		
+		loggerFrom(ctx).Info("获取到有效数据点", "app_id", appID, "data_type", w.dataType, "count", len(dataPoints))
+
 		// 分析数据粒度间隔
 		if len(dataPoints) > 1 {
 			sort.Slice(dataPoints, func(i, j int) bool {
 				return dataPoints[i].Timestamp < dataPoints[j].Timestamp
 			})
-			
+
 			intervals := make([]int64, 0)
 			for i := 1; i < len(dataPoints); i++ {
 				interval := dataPoints[i].Timestamp - dataPoints[i-1].Timestamp
 				intervals = append(intervals, interval)
 			}
-			
+
 			if len(intervals) > 0 {
 				var sum int64
 				min := intervals[0]
@@ -590,11 +748,13 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 					}
 				}
 				avg := sum / int64(len(intervals))
-				
-				log.Printf("站点 %s 数据时间间隔统计:", appID)
-				log.Printf("  - 最小间隔: %d 秒 (%.1f 分钟)", min, float64(min)/60)
-				log.Printf("  - 最大间隔: %d 秒 (%.1f 分钟)", max, float64(max)/60)
-				log.Printf("  - 平均间隔: %d 秒 (%.1f 分钟)", avg, float64(avg)/60)
+
+				loggerFrom(ctx).Debug("数据时间间隔统计",
+					"app_id", appID,
+					"min_interval_sec", min,
+					"max_interval_sec", max,
+					"avg_interval_sec", avg,
+				)
 			}
 		}
 	}
@@ -604,7 +764,7 @@ func (w *WAFCollector) getTrafficData(appID, deviceID string) []TrafficData {
 		dataPoints = append(dataPoints, TrafficData{Timestamp: time.Now().Unix()})
 	}
 
-	return dataPoints
+	return dataPoints, nil
 }
 
 // getFloatValue 从map中获取float值
@@ -622,26 +782,96 @@ func getFloatValue(m map[string]interface{}, key string) float64 {
 	return 0
 }
 
-// collectAllData 收集所有站点的数据
-func (w *WAFCollector) collectAllData() []ZabbixData {
-	// 登录验证
+// collectTrafficSnapshot 采集每个启用站点的最新一条流量数据，供Prometheus exporter使用；
+// 返回的第二个值表示本次是否成功连接WAF并取得数据（对应waf_collector_up）
+func (w *WAFCollector) collectTrafficSnapshot() ([]SiteSnapshot, bool) {
 	if !w.login() {
-		log.Println("无法登录WAF")
-		return nil
+		logger.Info("无法登录WAF")
+		return nil, false
 	}
 
-	// 获取设备ID
 	deviceID := w.getDeviceID()
 	if deviceID == "" {
-		log.Println("无法获取设备ID，尝试使用默认值")
 		deviceID = "default"
 	}
 
-	// 获取站点列表
 	sites := w.getSites()
 	if len(sites) == 0 {
-		log.Println("未发现任何站点")
-		return nil
+		return nil, false
+	}
+
+	jobs := make(chan Site)
+	results := make(chan SiteSnapshot)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range jobs {
+				if !site.Enabled {
+					results <- SiteSnapshot{Site: site.Name, SiteID: site.ID, DeviceID: deviceID, Enabled: false}
+					continue
+				}
+
+				actualDeviceID := deviceID
+				if site.StructID != "0" {
+					actualDeviceID = site.StructID
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), w.siteTimeout)
+				points, _ := w.getTrafficData(ctx, site.ID, actualDeviceID)
+				cancel()
+
+				var latest TrafficData
+				if len(points) > 0 {
+					latest = points[len(points)-1]
+				}
+
+				results <- SiteSnapshot{Site: site.Name, SiteID: site.ID, DeviceID: actualDeviceID, Enabled: true, Traffic: latest}
+			}
+		}()
+	}
+
+	go func() {
+		for _, site := range sites {
+			jobs <- site
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	snapshots := make([]SiteSnapshot, 0, len(sites))
+	for s := range results {
+		snapshots = append(snapshots, s)
+	}
+
+	return snapshots, true
+}
+
+// collectAllData 收集所有站点的数据，ctx作为各子请求的父级上下文（daemon模式下由
+// Scheduler传入可取消的ctx；一次性运行模式下传context.Background()）
+func (w *WAFCollector) collectAllData(ctx context.Context) ([]ZabbixData, error) {
+	start := time.Now()
+	defer func() { selfStats.recordCollectDuration(w.dataType, time.Since(start)) }()
+
+	// 登录验证，只在第一次调用时真正发起请求
+	if !w.ensureLoggedIn(ctx) {
+		return nil, fmt.Errorf("无法登录WAF(%s)", w.wafHost)
+	}
+
+	// 获取设备ID
+	deviceID := w.getDeviceIDContext(ctx)
+	if deviceID == "" {
+		loggerFrom(ctx).Info("无法获取设备ID，尝试使用默认值")
+		deviceID = "default"
+	}
+
+	// 获取站点列表
+	sites := w.getSitesContext(ctx)
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("未发现任何站点(%s)", w.wafHost)
 	}
 
 	// 收集数据
@@ -677,18 +907,33 @@ func (w *WAFCollector) collectAllData() []ZabbixData {
 			enableStr = "1"
 		}
 
-		discoveryData = append(discoveryData, map[string]string{
-			"{#SITE_ID}":    site.ID,
-			"{#SITE_NAME}":  site.Name,
-			"{#SITE_TYPE}":  "WAF",
-			"{#SITE_IP}":    "",
-			"{#SITE_PORT}":  "",
-			"{#SITE_DOMAIN}": "",
+		item := map[string]string{
+			"{#SITE_ID}":     site.ID,
+			"{#SITE_NAME}":   site.Name,
+			"{#SITE_TYPE}":   "WAF",
+			"{#SITE_IP}":     site.IP,
+			"{#SITE_PORT}":   site.Port,
+			"{#SITE_DOMAIN}": site.Domain,
 			"{#SITE_ENABLE}": enableStr,
-			"{#STRUCT_ID}":  siteDeviceID,
-			"{#DEVICE_ID}":  siteDeviceID,
-			"{#STRUCT_PK}":  site.StructID,
-		})
+			"{#STRUCT_ID}":   siteDeviceID,
+			"{#DEVICE_ID}":   siteDeviceID,
+			"{#STRUCT_PK}":   site.StructID,
+		}
+
+		if w.session.geoResolver != nil && site.IP != "" {
+			geo := w.session.geoResolver.Lookup(site.IP)
+			item["{#SITE_COUNTRY}"] = geo.Country
+			item["{#SITE_PROVINCE}"] = geo.Province
+			item["{#SITE_CITY}"] = geo.City
+			item["{#SITE_ISP}"] = geo.ISP
+		} else {
+			item["{#SITE_COUNTRY}"] = ""
+			item["{#SITE_PROVINCE}"] = ""
+			item["{#SITE_CITY}"] = ""
+			item["{#SITE_ISP}"] = ""
+		}
+
+		discoveryData = append(discoveryData, item)
 	}
 
 	// 添加LLD数据
@@ -700,182 +945,188 @@ func (w *WAFCollector) collectAllData() []ZabbixData {
 		Clock: timestamp,
 	})
 
-	// 收集每个站点的流量数据
-	for _, site := range sites {
-		siteName := site.Name
+	// 通过有界worker pool并发采集每个站点的数据，避免数百个站点时串行耗时过长
+	jobs := make(chan Site)
+	results := make(chan []ZabbixData)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range jobs {
+				results <- w.collectSiteData(ctx, site, deviceID, timestamp)
+			}
+		}()
+	}
 
-		// 站点状态
-		statusValue := 0
-		if site.Enabled {
-			statusValue = 1
+	go func() {
+		for _, site := range sites {
+			jobs <- site
 		}
-		allData = append(allData, ZabbixData{
-			Host:  w.zabbixHost,
-			Key:   fmt.Sprintf("waf.site.status[%s]", siteName),
-			Value: statusValue,
-			Clock: timestamp,
-		})
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
 
-		// 获取流量数据
-		if site.Enabled {
-			actualDeviceID := deviceID
-			if site.StructID != "0" {
-				actualDeviceID = site.StructID
-			}
-			
-			trafficDataPoints := w.getTrafficData(site.ID, actualDeviceID)
-			
-			// 处理所有数据点
-			for _, trafficData := range trafficDataPoints {
-				dataTimestamp := trafficData.Timestamp
-				
-				// 入站流量
-				allData = append(allData,
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.bytes_in_rate_avg[%s]", siteName),
-						Value: trafficData.BytesInRateAvg,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.bytes_in_rate_max[%s]", siteName),
-						Value: trafficData.BytesInRateMax,
-						Clock: dataTimestamp,
-					},
-				)
-				
-				// 出站流量
-				allData = append(allData,
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.bytes_out_rate_avg[%s]", siteName),
-						Value: trafficData.BytesOutRateAvg,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.bytes_out_rate_max[%s]", siteName),
-						Value: trafficData.BytesOutRateMax,
-						Clock: dataTimestamp,
-					},
-				)
-				
-				// 连接数
-				allData = append(allData,
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.conn_cur_avg[%s]", siteName),
-						Value: trafficData.ConnCurAvg,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.conn_cur_max[%s]", siteName),
-						Value: trafficData.ConnCurMax,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.conn_rate_avg[%s]", siteName),
-						Value: trafficData.ConnRateAvg,
-						Clock: dataTimestamp,
-					},
-				)
-				
-				// HTTP请求
-				allData = append(allData,
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.http_req_cnt_avg[%s]", siteName),
-						Value: trafficData.HTTPReqCntAvg,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.http_req_cnt_max[%s]", siteName),
-						Value: trafficData.HTTPReqCntMax,
-						Clock: dataTimestamp,
-					},
-					ZabbixData{
-						Host:  w.zabbixHost,
-						Key:   fmt.Sprintf("waf.site.http_req_rate_avg[%s]", siteName),
-						Value: trafficData.HTTPReqRateAvg,
-						Clock: dataTimestamp,
-					},
-				)
-			}
-			
-			log.Printf("站点 %s 收集了 %d 个数据点", siteName, len(trafficDataPoints))
-		} else {
-			// 站点禁用时，发送0值
-			zeroKeys := []string{
-				"bytes_in_rate_avg", "bytes_in_rate_max",
-				"bytes_out_rate_avg", "bytes_out_rate_max",
-				"conn_cur_avg", "conn_cur_max", "conn_rate_avg",
-				"http_req_cnt_avg", "http_req_cnt_max", "http_req_rate_avg",
-			}
-			
-			for _, key := range zeroKeys {
-				allData = append(allData, ZabbixData{
-					Host:  w.zabbixHost,
-					Key:   fmt.Sprintf("waf.site.%s[%s]", key, siteName),
-					Value: 0,
-					Clock: timestamp,
-				})
-			}
-		}
+	for siteData := range results {
+		allData = append(allData, siteData...)
 	}
 
-	return allData
+	return allData, nil
 }
 
-// sendToZabbix 发送数据到Zabbix
-func (w *WAFCollector) sendToZabbix(data []ZabbixData) bool {
-	if len(data) == 0 {
-		log.Println("没有数据需要发送")
-		return false
-	}
+// collectSiteData 采集单个站点的数据，在parentCtx基础上附加独立的超时，
+// 避免单个慢站点拖慢整体运行
+func (w *WAFCollector) collectSiteData(parentCtx context.Context, site Site, deviceID string, timestamp int64) []ZabbixData {
+	ctx, cancel := context.WithTimeout(parentCtx, w.siteTimeout)
+	defer cancel()
 
-	// 创建临时文件
-	tmpFile, err := os.CreateTemp("", "zabbix_sender_*.txt")
-	if err != nil {
-		log.Printf("创建临时文件失败: %v", err)
-		return false
+	siteName := site.Name
+	siteData := make([]ZabbixData, 0)
+
+	// 站点状态
+	statusValue := 0
+	if site.Enabled {
+		statusValue = 1
 	}
-	defer os.Remove(tmpFile.Name())
+	siteData = append(siteData, ZabbixData{
+		Host:  w.zabbixHost,
+		Key:   fmt.Sprintf("waf.site.status[%s]", siteName),
+		Value: statusValue,
+		Clock: timestamp,
+	})
 
-	// 写入数据
-	for _, item := range data {
-		key := item.Key
-		value := fmt.Sprintf("%v", item.Value)
-		
-		// 如果key包含空格或特殊字符，需要用引号包装
-		if strings.Contains(key, " ") || strings.Contains(key, "[") {
-			key = fmt.Sprintf(`"%s"`, key)
+	// 获取流量数据
+	if site.Enabled {
+		actualDeviceID := deviceID
+		if site.StructID != "0" {
+			actualDeviceID = site.StructID
 		}
-		
-		// 如果value是字符串且包含特殊字符，需要用引号包装
-		if strVal, ok := item.Value.(string); ok {
-			if strings.Contains(strVal, " ") || strings.Contains(strVal, `"`) || strings.Contains(strVal, "\n") {
-				// 转义内部的引号
-				strVal = strings.ReplaceAll(strVal, `\`, `\\`)
-				strVal = strings.ReplaceAll(strVal, `"`, `\"`)
-				value = fmt.Sprintf(`"%s"`, strVal)
+
+		fetchTime := time.Now()
+		trafficDataPoints, fetchErr := w.getTrafficData(ctx, site.ID, actualDeviceID)
+		if fetchErr != nil {
+			if err := w.state.SaveError(w.wafHost, w.zabbixHost, w.dataType, site.ID, fetchErr.Error()); err != nil {
+				loggerFrom(ctx).Error("记录站点采集失败状态出错", "site_name", siteName, "error", err)
 			}
+		} else {
+			w.saveLastRunTime(ctx, site.ID, fetchTime)
 		}
-		
-		line := fmt.Sprintf("%s %s %d %s\n", item.Host, key, item.Clock, value)
-		if _, err := tmpFile.WriteString(line); err != nil {
-			log.Printf("写入临时文件失败: %v", err)
-			return false
+
+		// 处理所有数据点
+		for _, trafficData := range trafficDataPoints {
+			dataTimestamp := trafficData.Timestamp
+
+			// 入站流量
+			siteData = append(siteData,
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.bytes_in_rate_avg[%s]", siteName),
+					Value: trafficData.BytesInRateAvg,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.bytes_in_rate_max[%s]", siteName),
+					Value: trafficData.BytesInRateMax,
+					Clock: dataTimestamp,
+				},
+			)
+
+			// 出站流量
+			siteData = append(siteData,
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.bytes_out_rate_avg[%s]", siteName),
+					Value: trafficData.BytesOutRateAvg,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.bytes_out_rate_max[%s]", siteName),
+					Value: trafficData.BytesOutRateMax,
+					Clock: dataTimestamp,
+				},
+			)
+
+			// 连接数
+			siteData = append(siteData,
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.conn_cur_avg[%s]", siteName),
+					Value: trafficData.ConnCurAvg,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.conn_cur_max[%s]", siteName),
+					Value: trafficData.ConnCurMax,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.conn_rate_avg[%s]", siteName),
+					Value: trafficData.ConnRateAvg,
+					Clock: dataTimestamp,
+				},
+			)
+
+			// HTTP请求
+			siteData = append(siteData,
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.http_req_cnt_avg[%s]", siteName),
+					Value: trafficData.HTTPReqCntAvg,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.http_req_cnt_max[%s]", siteName),
+					Value: trafficData.HTTPReqCntMax,
+					Clock: dataTimestamp,
+				},
+				ZabbixData{
+					Host:  w.zabbixHost,
+					Key:   fmt.Sprintf("waf.site.http_req_rate_avg[%s]", siteName),
+					Value: trafficData.HTTPReqRateAvg,
+					Clock: dataTimestamp,
+				},
+			)
+		}
+
+		loggerFrom(ctx).Info("站点数据采集完成", "site_name", siteName, "data_type", w.dataType, "points", len(trafficDataPoints))
+	} else {
+		// 站点禁用时，发送0值
+		zeroKeys := []string{
+			"bytes_in_rate_avg", "bytes_in_rate_max",
+			"bytes_out_rate_avg", "bytes_out_rate_max",
+			"conn_cur_avg", "conn_cur_max", "conn_rate_avg",
+			"http_req_cnt_avg", "http_req_cnt_max", "http_req_rate_avg",
+		}
+
+		for _, key := range zeroKeys {
+			siteData = append(siteData, ZabbixData{
+				Host:  w.zabbixHost,
+				Key:   fmt.Sprintf("waf.site.%s[%s]", key, siteName),
+				Value: 0,
+				Clock: timestamp,
+			})
 		}
 	}
-	tmpFile.Close()
 
-	log.Printf("临时文件路径: %s", tmpFile.Name())
-	log.Printf("准备发送 %d 个数据项到Zabbix", len(data))
-	
+	return siteData
+}
+
+// sendToZabbix 通过原生Zabbix sender协议发送数据到Zabbix，不再依赖zabbix_sender二进制
+func (w *WAFCollector) sendToZabbix(ctx context.Context, data []ZabbixData) bool {
+	if len(data) == 0 {
+		loggerFrom(ctx).Info("没有数据需要发送")
+		return false
+	}
+
+	loggerFrom(ctx).Info("准备发送数据到Zabbix", "count", len(data), "zabbix_server", w.zabbixServer)
+
 	// 统计发送数据的时间戳分布
 	timestampsByKey := make(map[string]map[int64]bool)
 	for _, item := range data {
@@ -887,11 +1138,11 @@ func (w *WAFCollector) sendToZabbix(data []ZabbixData) bool {
 			timestampsByKey[keyPrefix][item.Clock] = true
 		}
 	}
-	
-	log.Println("发送数据的时间戳统计:")
+
+	loggerFrom(ctx).Info("发送数据的时间戳统计")
 	for keyPrefix, timestamps := range timestampsByKey {
 		if len(timestamps) > 0 {
-			log.Printf("  - %s: %d 个不同时间戳", keyPrefix, len(timestamps))
+			loggerFrom(ctx).Info("时间戳分布", "key_prefix", keyPrefix, "distinct_timestamps", len(timestamps))
 			if len(timestamps) > 1 {
 				// 计算间隔
 				var tsList []int64
@@ -899,59 +1150,41 @@ func (w *WAFCollector) sendToZabbix(data []ZabbixData) bool {
 					tsList = append(tsList, ts)
 				}
 				sort.Slice(tsList, func(i, j int) bool { return tsList[i] < tsList[j] })
-				
+
 				var intervals []int64
 				for i := 1; i < len(tsList); i++ {
 					intervals = append(intervals, tsList[i]-tsList[i-1])
 				}
-				
+
 				if len(intervals) > 0 {
 					var sum int64
 					for _, interval := range intervals {
 						sum += interval
 					}
 					avgInterval := float64(sum) / float64(len(intervals))
-					log.Printf("    平均间隔: %.1f 秒 (%.1f 分钟)", avgInterval, avgInterval/60)
+					loggerFrom(ctx).Info("时间戳平均间隔", "key_prefix", keyPrefix, "avg_interval_sec", avgInterval, "avg_interval_min", avgInterval/60)
 				}
 			}
 		}
 	}
 
-	// 检查zabbix_sender是否存在
-	zabbixSenderPath, err := exec.LookPath("zabbix_sender")
+	result, err := w.sender.Send(ctx, data)
 	if err != nil {
-		log.Printf("zabbix_sender命令未找到，请先安装zabbix-sender")
+		loggerFrom(ctx).Error("发送数据到Zabbix失败", "error", err)
 		return false
 	}
+	selfStats.recordZabbixSend(result.Processed, result.Failed)
 
-	// 使用zabbix_sender发送
-	cmd := exec.Command(zabbixSenderPath,
-		"-z", w.zabbixServer,
-		"-i", tmpFile.Name(),
-		"-vv",
-		"-T",
-	)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("Zabbix sender失败: %v", err)
-		log.Printf("标准错误: %s", stderr.String())
-		if stdout.Len() > 0 {
-			log.Printf("标准输出: %s", stdout.String())
-		}
-		return false
+	loggerFrom(ctx).Info("Zabbix处理结果", "processed", result.Processed, "failed", result.Failed, "total", result.Total)
+	if result.Failed > 0 {
+		loggerFrom(ctx).Warn("部分数据项被Zabbix server拒绝", "failed", result.Failed)
 	}
 
-	log.Printf("成功发送 %d 个数据项到Zabbix", len(data))
-	return true
+	return result.Failed == 0
 }
 
 // sendCollectorStatus 发送采集器状态
-func (w *WAFCollector) sendCollectorStatus(status int) {
+func (w *WAFCollector) sendCollectorStatus(ctx context.Context, status int) {
 	data := []ZabbixData{
 		{
 			Host:  w.zabbixHost,
@@ -960,76 +1193,174 @@ func (w *WAFCollector) sendCollectorStatus(status int) {
 			Clock: time.Now().Unix(),
 		},
 	}
-	w.sendToZabbix(data)
+	w.sendToZabbix(ctx, data)
 }
 
-// run 运行采集器
+// run 运行采集器（一次性采集并推送模式下使用）。每次run()会生成一个trace_id
+// 并绑定到ctx上，本次调用链上产生的所有日志都会带上这个trace_id，方便把一次
+// Zabbix推送失败关联回具体是哪次运行、哪个上游API调用导致的
 func (w *WAFCollector) run() bool {
-	log.Println("开始采集WAF数据...")
-	
-	// 记录本次运行时间
-	currentRunTime := time.Now()
-	
-	// 收集数据
-	data := w.collectAllData()
-	
+	traceID := newTraceID()
+	ctx := withTraceID(context.Background(), traceID)
+	log := loggerFrom(ctx)
+
+	log.Info("开始采集WAF数据...")
+
+	// 收集数据；每个站点的游标在collectSiteData中独立推进，不再依赖整体运行是否成功
+	data, err := w.collectAllData(ctx)
+	if err != nil {
+		log.Error("采集数据失败", "error", err)
+		w.sendCollectorStatus(ctx, 0)
+		return false
+	}
+
 	if len(data) > 0 {
-		log.Printf("收集到 %d 个数据项", len(data))
-		
+		log.Info("收集到数据项", "count", len(data))
+
 		// 发送到Zabbix
-		if w.sendToZabbix(data) {
-			log.Println("数据发送成功")
-			// 成功后保存运行时间
-			w.saveLastRunTime(currentRunTime)
+		if w.sendToZabbix(ctx, data) {
+			log.Info("数据发送成功")
 			return true
 		}
-		
-		log.Println("数据发送失败")
-		w.sendCollectorStatus(0)
+
+		log.Info("数据发送失败")
+		w.sendCollectorStatus(ctx, 0)
 		return false
 	}
-	
-	log.Println("未收集到任何数据")
-	w.sendCollectorStatus(0)
+
+	log.Info("未收集到任何数据")
+	w.sendCollectorStatus(ctx, 0)
 	return false
 }
 
 func main() {
 	// 命令行参数
 	var (
-		wafHost      = flag.String("waf-host", "", "WAF管理地址")
-		token        = flag.String("token", "", "API认证令牌")
-		zabbixServer = flag.String("zabbix-server", "", "Zabbix服务器地址")
-		zabbixHost   = flag.String("zabbix-host", "", "Zabbix中的主机名")
-		dataType     = flag.String("data-type", "mins", "数据粒度类型，可选：mins, hours, days")
-		debug        = flag.Bool("debug", false, "启用调试模式")
-		quiet        = flag.Bool("quiet", false, "静默模式，不输出日志")
+		wafHost       = flag.String("waf-host", "", "WAF管理地址")
+		token         = flag.String("token", "", "API认证令牌")
+		zabbixServer  = flag.String("zabbix-server", "", "Zabbix服务器地址")
+		zabbixHost    = flag.String("zabbix-host", "", "Zabbix中的主机名")
+		dataType      = flag.String("data-type", "mins", "数据粒度类型，可选：mins, hours, days")
+		debug         = flag.Bool("debug", false, "启用调试模式")
+		quiet         = flag.Bool("quiet", false, "静默模式，只输出error级别日志（等价于-log-level=error）")
+		zabbixChunk   = flag.Int("zabbix-chunk-size", defaultChunkSize, "单次发送到Zabbix的最大数据项数")
+		zabbixTLSMode = flag.String("zabbix-tls-mode", "none", "Zabbix连接加密方式，可选：none, cert, psk")
+		zabbixTLSCert = flag.String("zabbix-tls-cert", "", "TLS客户端证书文件路径（cert模式）")
+		zabbixTLSKey  = flag.String("zabbix-tls-key", "", "TLS客户端私钥文件路径（cert模式）")
+		zabbixPSKID   = flag.String("zabbix-tls-psk-identity", "", "TLS-PSK identity（psk模式）")
+		zabbixPSKKey  = flag.String("zabbix-tls-psk-key", "", "TLS-PSK key（psk模式）")
+		concurrency   = flag.Int("concurrency", 5, "并发采集站点数")
+		rateLimit     = flag.Int("rate-limit", 0, "对WAF API的每秒最大请求数，0表示按concurrency自动估算")
+		mode          = flag.String("mode", "sender", "运行模式，可选：sender（一次性采集并推送到Zabbix）, exporter（以Prometheus导出器长驻运行）, daemon（长驻运行，mins/hours/days各自按自己的周期采集并推送）")
+		listen        = flag.String("listen", ":9187", "exporter模式下的HTTP监听地址")
+		exporterCache = flag.Duration("exporter-cache-ttl", 15*time.Second, "exporter模式下两次真实采集之间的最小间隔")
+		metricsListen = flag.String("metrics-listen", "", "sender/daemon模式下自监控指标(/metrics、/healthz、/readyz)的HTTP监听地址，不指定则不启动")
+		logFormat     = flag.String("log-format", "text", "日志输出格式，可选：text（即console）, json")
+		logLevel      = flag.String("log-level", "info", "日志级别，可选：debug, info, warn, error")
+		logFile       = flag.String("log-file", "", "日志文件路径，指定后按log-max-*参数轮转；不指定则只输出到stderr")
+		logMaxSize    = flag.Int("log-max-size", 100, "单个日志文件的最大大小（MB），超过后触发轮转")
+		logMaxBackups = flag.Int("log-max-backups", 7, "最多保留的历史日志文件份数")
+		logMaxAge     = flag.Int("log-max-age", 30, "历史日志文件最多保留的天数")
+		logCompress   = flag.Bool("log-compress", false, "是否gzip压缩轮转后的历史日志文件")
+		configPath    = flag.String("config", "", "配置文件路径（yaml），指定后将忽略单设备flag，按配置文件中的设备列表并行运行")
+		geoipDB       = flag.String("geoip-db", "", "GeoIP2 City(.mmdb)数据库路径，用于为站点LLD补充国家/省份/城市信息，不指定则不启用")
+		geoipASNDB    = flag.String("geoip-asn-db", "", "GeoIP2 ASN(.mmdb)数据库路径，用于补充SITE_ISP宏；City库不含ISP字段，不指定该参数时SITE_ISP始终为空")
+		stateDBPath   = flag.String("state-db", "/var/lib/zabmetrics/state.db", "采集游标SQLite数据库路径，按(waf_host,zabbix_host,data_type,app_id)独立保存每个站点的游标")
 	)
-	
+
 	flag.Parse()
-	
+
+	// 配置结构化日志；debug/quiet作为旧版本的兼容别名保留
+	initLogging(*logFormat, *logLevel, *quiet, *debug, logFileConfig{
+		Path:       *logFile,
+		MaxSizeMB:  *logMaxSize,
+		MaxBackups: *logMaxBackups,
+		MaxAgeDays: *logMaxAge,
+		Compress:   *logCompress,
+	})
+
+	if *configPath != "" {
+		runWithConfig(*configPath, *listen, *exporterCache, *stateDBPath, *metricsListen)
+		return
+	}
+
 	// 参数验证
-	if *wafHost == "" || *token == "" || *zabbixServer == "" || *zabbixHost == "" {
+	if *wafHost == "" || *token == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
-	
-	// 配置日志
-	if *quiet {
-		log.SetOutput(io.Discard)
-	} else if !*debug {
-		// 非调试模式下，只输出重要信息
-		log.SetFlags(log.Ldate | log.Ltime)
-	} else {
-		log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if (*mode == "sender" || *mode == "daemon") && (*zabbixServer == "" || *zabbixHost == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// 构建Zabbix TLS配置
+	var tlsConfig *ZabbixTLSConfig
+	if *zabbixTLSMode != "" && *zabbixTLSMode != string(ZabbixTLSNone) {
+		tlsConfig = &ZabbixTLSConfig{
+			Mode:        ZabbixTLSMode(*zabbixTLSMode),
+			CertFile:    *zabbixTLSCert,
+			KeyFile:     *zabbixTLSKey,
+			PSKIdentity: *zabbixPSKID,
+			PSKKey:      *zabbixPSKKey,
+		}
+	}
+
+	state, err := NewStateStore(*stateDBPath)
+	if err != nil {
+		logger.Error("打开采集游标数据库失败", "path", *stateDBPath, "error", err)
+		os.Exit(1)
+	}
+	defer state.Close()
+
+	if *metricsListen != "" {
+		go runSelfMetricsServer(*metricsListen)
+	}
+
+	if *mode == "daemon" {
+		runDaemon(daemonOptions{
+			WAFHost:        *wafHost,
+			Token:          *token,
+			ZabbixServer:   *zabbixServer,
+			ZabbixHost:     *zabbixHost,
+			ZabbixTLS:      tlsConfig,
+			ChunkSize:      *zabbixChunk,
+			Concurrency:    *concurrency,
+			RateLimit:      *rateLimit,
+			GeoIPDBPath:    *geoipDB,
+			GeoIPASNDBPath: *geoipASNDB,
+			State:          state,
+		})
+		return
 	}
-	
-	// 创建采集器并运行
-	collector := NewWAFCollector(*wafHost, *token, *zabbixServer, *zabbixHost, *dataType)
-	
-	// 执行数据采集
+
+	// 创建采集器
+	collector := NewWAFCollector(WAFCollectorOptions{
+		WAFHost:        *wafHost,
+		Token:          *token,
+		ZabbixServer:   *zabbixServer,
+		ZabbixHost:     *zabbixHost,
+		DataType:       *dataType,
+		ZabbixTLS:      tlsConfig,
+		ChunkSize:      *zabbixChunk,
+		Concurrency:    *concurrency,
+		RateLimit:      *rateLimit,
+		GeoIPDBPath:    *geoipDB,
+		GeoIPASNDBPath: *geoipASNDB,
+		State:          state,
+	})
+
+	if *mode == "exporter" {
+		if err := runExporter(collector, *listen, *exporterCache); err != nil {
+			logger.Error("exporter服务退出", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// sender模式：执行一次性数据采集并通过Zabbix sender协议推送
 	success := collector.run()
-	
+
 	// 输出结果：0表示成功，1表示失败
 	if success {
 		fmt.Println(0)
@@ -1038,4 +1369,80 @@ func main() {
 		fmt.Println(1)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
+
+// runWithConfig 从配置文件加载设备列表，为每个设备创建独立的WAFCollector。daemon模式下
+// 委托给runDaemonWithHotReload长驻运行并监听配置文件变化，动态启停WAF目标；其余模式
+// （exporter/sender）仍是一次性为每个设备创建WAFCollector后并行运行。所有设备共用
+// 同一个采集游标数据库，游标的(waf_host, zabbix_host, data_type, app_id)复合键本身
+// 就能区分不同设备，不需要每个设备单独开一个数据库文件
+func runWithConfig(configPath, listen string, exporterCache time.Duration, stateDBPath, metricsListen string) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		logger.Error("加载配置文件失败", "path", configPath, "error", err)
+		os.Exit(1)
+	}
+
+	state, err := NewStateStore(stateDBPath)
+	if err != nil {
+		logger.Error("打开采集游标数据库失败", "path", stateDBPath, "error", err)
+		os.Exit(1)
+	}
+	defer state.Close()
+
+	if metricsListen != "" && cfg.Mode != "exporter" {
+		go runSelfMetricsServer(metricsListen)
+	}
+
+	if cfg.Mode == "daemon" {
+		runDaemonWithHotReload(configPath, cfg, state)
+		return
+	}
+
+	collectors := make([]*WAFCollector, 0, len(cfg.Devices))
+	for _, dev := range cfg.Devices {
+		collectors = append(collectors, NewWAFCollector(dev.toOptions(cfg.ZabbixServer, cfg.GeoIPDB, cfg.GeoIPASNDB, state)))
+	}
+
+	if cfg.Mode == "exporter" {
+		mux := http.NewServeMux()
+		for i, collector := range collectors {
+			path := fmt.Sprintf("/metrics/%s", cfg.Devices[i].ZabbixHost)
+			mux.Handle(path, NewExporter(collector, exporterCache))
+		}
+		registerHealthEndpoints(mux)
+		logger.Info("以exporter模式启动（多设备）", "listen", listen, "devices", len(collectors))
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logger.Error("exporter服务退出", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	results := make([]bool, len(collectors))
+	for i, collector := range collectors {
+		wg.Add(1)
+		go func(i int, c *WAFCollector) {
+			defer wg.Done()
+			results[i] = c.run()
+		}(i, collector)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, ok := range results {
+		if !ok {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		logger.Error("部分设备采集失败", "failed", failed, "total", len(results))
+		fmt.Println(1)
+		os.Exit(1)
+	}
+
+	fmt.Println(0)
+	os.Exit(0)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Zabbix sender协议相关常量
+const (
+	zbxHeaderMagic     = "ZBXD"
+	zbxFlagProtocol    = 0x01 // 固定置位，标识这是Zabbix协议包
+	zbxFlagCompressed  = 0x02 // payload经过zlib压缩
+	zbxFlagLargePacket = 0x04 // 使用8字节长度字段，支持超过4GB的包（预留，实际极少用到）
+	zbxHeaderLenNormal = 13   // "ZBXD" + flags(1) + length(4) + reserved(4)
+	zbxHeaderLenLarge  = 21   // "ZBXD" + flags(1) + length(8) + reserved(8)
+	defaultChunkSize   = 250
+	defaultSendTimeout = 10 * time.Second
+	defaultMaxRetries  = 3
+	defaultCompressMin = 1024 // payload超过这个大小才启用zlib压缩，太小的包压缩反而增加开销
+)
+
+// ZabbixTLSMode Zabbix trapper连接的加密方式
+type ZabbixTLSMode string
+
+const (
+	ZabbixTLSNone ZabbixTLSMode = "none"
+	ZabbixTLSCert ZabbixTLSMode = "cert"
+	ZabbixTLSPSK  ZabbixTLSMode = "psk"
+)
+
+// ZabbixTLSConfig Zabbix sender的TLS配置
+type ZabbixTLSConfig struct {
+	Mode        ZabbixTLSMode
+	CertFile    string
+	KeyFile     string
+	CAFile      string
+	PSKIdentity string
+	PSKKey      string
+	SkipVerify  bool
+}
+
+// ZabbixSendResult 一次发送的汇总结果
+type ZabbixSendResult struct {
+	Processed int
+	Failed    int
+	Total     int
+}
+
+// ZabbixSender 原生Zabbix sender协议客户端，替代对zabbix_sender二进制的依赖
+type ZabbixSender struct {
+	server      string
+	timeout     time.Duration
+	chunkSize   int
+	maxRetries  int
+	tlsConfig   *ZabbixTLSConfig
+	compressMin int // payload超过这个字节数才启用zlib压缩，0表示使用默认值，负数表示禁用压缩
+}
+
+// senderRequest Zabbix trapper请求体
+type senderRequest struct {
+	Request string       `json:"request"`
+	Data    []ZabbixData `json:"data"`
+	Clock   int64        `json:"clock"`
+}
+
+// senderResponse Zabbix trapper响应体
+type senderResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+var senderInfoPattern = regexp.MustCompile(`processed:\s*(\d+);\s*failed:\s*(\d+);\s*total:\s*(\d+)`)
+
+// NewZabbixSender 创建原生Zabbix sender客户端
+func NewZabbixSender(server string, tlsConfig *ZabbixTLSConfig) *ZabbixSender {
+	return &ZabbixSender{
+		server:     server,
+		timeout:    defaultSendTimeout,
+		chunkSize:  defaultChunkSize,
+		maxRetries: defaultMaxRetries,
+		tlsConfig:  tlsConfig,
+	}
+}
+
+// SetChunkSize 设置单次发送的最大条目数
+func (s *ZabbixSender) SetChunkSize(size int) {
+	if size > 0 {
+		s.chunkSize = size
+	}
+}
+
+// SetCompressThreshold 设置启用zlib压缩的payload大小阈值（字节），
+// 传入负数表示禁用压缩
+func (s *ZabbixSender) SetCompressThreshold(bytes int) {
+	s.compressMin = bytes
+}
+
+func (s *ZabbixSender) compressThreshold() int {
+	if s.compressMin != 0 {
+		return s.compressMin
+	}
+	return defaultCompressMin
+}
+
+// dial 建立到Zabbix server的连接，按需启用TLS
+func (s *ZabbixSender) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	if s.tlsConfig == nil || s.tlsConfig.Mode == "" || s.tlsConfig.Mode == ZabbixTLSNone {
+		return dialer.DialContext(ctx, "tcp", s.server)
+	}
+
+	switch s.tlsConfig.Mode {
+	case ZabbixTLSCert:
+		cfg := &tls.Config{InsecureSkipVerify: s.tlsConfig.SkipVerify}
+		if s.tlsConfig.CertFile != "" && s.tlsConfig.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(s.tlsConfig.CertFile, s.tlsConfig.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("加载客户端证书失败: %v", err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		tlsDialer := tls.Dialer{NetDialer: dialer, Config: cfg}
+		return tlsDialer.DialContext(ctx, "tcp", s.server)
+	case ZabbixTLSPSK:
+		// Go标准库crypto/tls不支持Zabbix所用的GnuTLS PSK密码套件，无法在不引入
+		// 额外依赖的情况下真正加密；绝不能静默退化为明文连接，否则用户会以为自己
+		// 的发送流量是加密的。直接拒绝连接，要求用户改用cert模式或zabbix_sender二进制。
+		return nil, fmt.Errorf("TLS-PSK模式当前不被Go标准库支持，拒绝以明文连接(psk_identity=%s)；请改用-zabbix-tls-mode=cert或zabbix_sender二进制", s.tlsConfig.PSKIdentity)
+	default:
+		return dialer.DialContext(ctx, "tcp", s.server)
+	}
+}
+
+// encodePacket 按Zabbix sender协议封装请求包。payload超过compressThreshold时
+// 用zlib压缩并置位0x02，reserved字段改为存放压缩前的长度；长度超出uint32范围
+// 时置位0x04并改用8字节长度字段（大包场景在本项目的数据量下基本不会触发）
+func (s *ZabbixSender) encodePacket(payload []byte) ([]byte, error) {
+	flags := byte(zbxFlagProtocol)
+	rawLen := len(payload)
+
+	threshold := s.compressThreshold()
+	if threshold >= 0 && len(payload) > threshold {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, fmt.Errorf("压缩发送数据失败: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("压缩发送数据失败: %v", err)
+		}
+		flags |= zbxFlagCompressed
+		payload = buf.Bytes()
+	}
+
+	if uint64(len(payload)) > uint64(^uint32(0)) {
+		flags |= zbxFlagLargePacket
+		header := make([]byte, zbxHeaderLenLarge)
+		copy(header[:4], zbxHeaderMagic)
+		header[4] = flags
+		binary.LittleEndian.PutUint64(header[5:13], uint64(len(payload)))
+		binary.LittleEndian.PutUint64(header[13:21], uint64(rawLen))
+		return append(header, payload...), nil
+	}
+
+	header := make([]byte, zbxHeaderLenNormal)
+	copy(header[:4], zbxHeaderMagic)
+	header[4] = flags
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[9:13], uint32(rawLen))
+	return append(header, payload...), nil
+}
+
+// readPacket 从连接中读取一个完整的Zabbix协议响应包，按响应头的flags解压缩
+func readPacket(conn net.Conn) ([]byte, error) {
+	header := make([]byte, zbxHeaderLenNormal)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("读取响应头失败: %v", err)
+	}
+	if string(header[:4]) != zbxHeaderMagic {
+		return nil, fmt.Errorf("无效的响应头: %q", header[:4])
+	}
+	flags := header[4]
+
+	var length uint64
+	if flags&zbxFlagLargePacket != 0 {
+		rest := make([]byte, zbxHeaderLenLarge-zbxHeaderLenNormal)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return nil, fmt.Errorf("读取大包响应头失败: %v", err)
+		}
+		full := append(header, rest...)
+		length = binary.LittleEndian.Uint64(full[5:13])
+	} else {
+		length = uint64(binary.LittleEndian.Uint32(header[5:9]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, fmt.Errorf("读取响应体失败: %v", err)
+	}
+
+	if flags&zbxFlagCompressed != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("解压响应失败: %v", err)
+		}
+		defer zr.Close()
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("解压响应失败: %v", err)
+		}
+		return decompressed, nil
+	}
+
+	return payload, nil
+}
+
+// sendOnce 建立一次连接并发送一个已序列化的包
+func (s *ZabbixSender) sendOnce(ctx context.Context, payload []byte) (*ZabbixSendResult, error) {
+	packet, err := s.encodePacket(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("连接Zabbix server(%s)失败: %v", s.server, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("写入数据失败: %v", err)
+	}
+
+	respPayload, err := readPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp senderResponse
+	if err := json.Unmarshal(respPayload, &resp); err != nil {
+		return nil, fmt.Errorf("解析响应失败: %v", err)
+	}
+
+	matches := senderInfoPattern.FindStringSubmatch(resp.Info)
+	if matches == nil {
+		return nil, fmt.Errorf("无法解析响应info字段: %s", resp.Info)
+	}
+
+	processed, _ := strconv.Atoi(matches[1])
+	failed, _ := strconv.Atoi(matches[2])
+	total, _ := strconv.Atoi(matches[3])
+
+	return &ZabbixSendResult{Processed: processed, Failed: failed, Total: total}, nil
+}
+
+// sendChunk 发送一批数据项，sendOnce返回的任何错误（连接、IO、响应解析）都会触发
+// 指数退避重试，退避间隔依次为500ms、1s、2s……
+func (s *ZabbixSender) sendChunk(ctx context.Context, items []ZabbixData) (*ZabbixSendResult, error) {
+	req := senderRequest{Request: "sender data", Data: items, Clock: time.Now().Unix()}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("序列化发送数据失败: %v", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := (500 * time.Millisecond) << (attempt - 1)
+			logger.Debug("Zabbix sender重试", "attempt", attempt, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		result, err := s.sendOnce(ctx, payload)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+		logger.Warn("发送数据到Zabbix失败", "attempt", attempt+1, "max_attempts", s.maxRetries+1, "error", err)
+	}
+
+	return nil, fmt.Errorf("发送数据到Zabbix最终失败: %v", lastErr)
+}
+
+// Send 按chunkSize分批发送全部数据项，返回汇总的processed/failed/total
+func (s *ZabbixSender) Send(ctx context.Context, items []Metric) (*ZabbixSendResult, error) {
+	if len(items) == 0 {
+		return &ZabbixSendResult{}, nil
+	}
+
+	chunkSize := s.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	total := &ZabbixSendResult{}
+	for i := 0; i < len(items); i += chunkSize {
+		end := i + chunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		result, err := s.sendChunk(ctx, items[i:end])
+		if err != nil {
+			return total, err
+		}
+		total.Processed += result.Processed
+		total.Failed += result.Failed
+		total.Total += result.Total
+	}
+
+	return total, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// writeFrame 在独立goroutine里把一帧数据写入net.Pipe的一端：net.Pipe是同步的，
+// 写入会阻塞到对端读取为止，所以不能和readPacket在同一个goroutine里执行
+func writeFrame(t *testing.T, conn net.Conn, frame []byte) {
+	t.Helper()
+	go func() {
+		if _, err := conn.Write(frame); err != nil {
+			t.Errorf("写入测试帧失败: %v", err)
+		}
+	}()
+}
+
+func TestReadPacketNormalHeader(t *testing.T) {
+	body := []byte(`{"response":"success","info":"processed: 3; failed: 0; total: 3"}`)
+
+	header := make([]byte, zbxHeaderLenNormal)
+	copy(header[:4], zbxHeaderMagic)
+	header[4] = zbxFlagProtocol
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(body)))
+	binary.LittleEndian.PutUint32(header[9:13], uint32(len(body)))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writeFrame(t, client, append(header, body...))
+
+	got, err := readPacket(server)
+	if err != nil {
+		t.Fatalf("readPacket返回错误: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("读取到的响应体不匹配: got %q, want %q", got, body)
+	}
+}
+
+func TestReadPacketLargePacketHeader(t *testing.T) {
+	body := []byte(`{"response":"success","info":"processed: 1000; failed: 0; total: 1000"}`)
+
+	header := make([]byte, zbxHeaderLenLarge)
+	copy(header[:4], zbxHeaderMagic)
+	header[4] = zbxFlagProtocol | zbxFlagLargePacket
+	binary.LittleEndian.PutUint64(header[5:13], uint64(len(body)))
+	binary.LittleEndian.PutUint64(header[13:21], uint64(len(body)))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writeFrame(t, client, append(header, body...))
+
+	got, err := readPacket(server)
+	if err != nil {
+		t.Fatalf("readPacket返回错误: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("大包响应体读取不匹配: got %q, want %q", got, body)
+	}
+}
+
+func TestEncodePacketNormalHeader(t *testing.T) {
+	s := NewZabbixSender("127.0.0.1:10051", nil)
+	payload := []byte(`{"request":"sender data","data":[]}`)
+
+	packet, err := s.encodePacket(payload)
+	if err != nil {
+		t.Fatalf("encodePacket返回错误: %v", err)
+	}
+	if string(packet[:4]) != zbxHeaderMagic {
+		t.Fatalf("包头magic不正确: %q", packet[:4])
+	}
+	if packet[4]&zbxFlagCompressed != 0 {
+		t.Fatalf("小payload不应该被压缩")
+	}
+
+	length := binary.LittleEndian.Uint32(packet[5:9])
+	if int(length) != len(payload) {
+		t.Fatalf("包头长度字段不正确: got %d, want %d", length, len(payload))
+	}
+	if !bytes.Equal(packet[zbxHeaderLenNormal:], payload) {
+		t.Fatalf("包体与payload不一致")
+	}
+}
+
+func TestEncodePacketCompressesLargePayload(t *testing.T) {
+	s := NewZabbixSender("127.0.0.1:10051", nil)
+	s.SetCompressThreshold(10)
+
+	data := make([]ZabbixData, 100)
+	for i := range data {
+		data[i] = ZabbixData{Host: "h", Key: "k", Value: "v"}
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("序列化测试数据失败: %v", err)
+	}
+
+	packet, err := s.encodePacket(payload)
+	if err != nil {
+		t.Fatalf("encodePacket返回错误: %v", err)
+	}
+	if packet[4]&zbxFlagCompressed == 0 {
+		t.Fatalf("超过阈值的payload应该被压缩")
+	}
+
+	rawLen := binary.LittleEndian.Uint32(packet[9:13])
+	if int(rawLen) != len(payload) {
+		t.Fatalf("reserved字段应该记录压缩前长度: got %d, want %d", rawLen, len(payload))
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	s := NewZabbixSender("127.0.0.1:10051", nil)
+	payload := []byte(`{"request":"sender data","data":[{"host":"h","key":"k","value":"v"}]}`)
+
+	packet, err := s.encodePacket(payload)
+	if err != nil {
+		t.Fatalf("encodePacket返回错误: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writeFrame(t, client, packet)
+
+	got, err := readPacket(server)
+	if err != nil {
+		t.Fatalf("readPacket返回错误: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("往返解码后的payload不一致: got %q, want %q", got, payload)
+	}
+}
+
+func TestDialRejectsPSKMode(t *testing.T) {
+	s := NewZabbixSender("127.0.0.1:10051", &ZabbixTLSConfig{
+		Mode:        ZabbixTLSPSK,
+		PSKIdentity: "test-identity",
+		PSKKey:      "deadbeef",
+	})
+
+	if _, err := s.dial(context.Background()); err == nil {
+		t.Fatalf("TLS-PSK模式应该返回错误而不是静默退化为明文连接")
+	}
+}